@@ -5,27 +5,35 @@ import (
 	"fmt"
 )
 
-type StampBuffer struct {
-	b []string
+// KeyedStampBuffer is a ring buffer of keys. It holds at most its size
+// minus one keys.
+type KeyedStampBuffer[K comparable] struct {
+	b []K
 	r int64
 	w int64
 }
 
-func NewStampBuffer(size int64) *StampBuffer {
-	return &StampBuffer{
-		b: make([]string, size),
+type StampBuffer = KeyedStampBuffer[string]
+
+func NewKeyedStampBuffer[K comparable](size int64) *KeyedStampBuffer[K] {
+	return &KeyedStampBuffer[K]{
+		b: make([]K, size),
 		r: 0,
 		w: 0,
 	}
 }
 
-func (s *StampBuffer) String() string {
+func NewStampBuffer(size int64) *StampBuffer {
+	return NewKeyedStampBuffer[string](size)
+}
+
+func (s *KeyedStampBuffer[K]) String() string {
 	return fmt.Sprintf("read: %d, write: %d, %v, ", s.r, s.w, s.b)
 }
 
 var ErrNothingToPop = errors.New("nothing to pop")
 
-func (s *StampBuffer) PopIfFullThenPush(val string) (pop string, err error) {
+func (s *KeyedStampBuffer[K]) PopIfFullThenPush(val K) (pop K, err error) {
 	if s.r > s.w || s.w == s.Cap()-1 {
 		pop = s.b[s.r]
 	} else {
@@ -36,7 +44,7 @@ func (s *StampBuffer) PopIfFullThenPush(val string) (pop string, err error) {
 	return
 }
 
-func (s *StampBuffer) Push(val string) {
+func (s *KeyedStampBuffer[K]) Push(val K) {
 	s.b[s.w] = val
 
 	s.incWritePosition()
@@ -44,16 +52,41 @@ func (s *StampBuffer) Push(val string) {
 
 var ErrIsEmpty = errors.New("buffer is empty")
 
-func (s *StampBuffer) Pop() (string, error) {
+func (s *KeyedStampBuffer[K]) Pop() (K, error) {
 	if s.IsEmpty() {
-		return "", ErrIsEmpty
+		var zero K
+		return zero, ErrIsEmpty
 	}
 	val := s.b[s.r]
 	s.incReadPosition()
 	return val, nil
 }
 
-func (s *StampBuffer) incWritePosition() {
+// Values returns the buffered values from the next one to pop to the last
+// one pushed.
+func (s *KeyedStampBuffer[K]) Values() []K {
+	var vals []K
+	for i := s.r; i != s.w; {
+		vals = append(vals, s.b[i])
+		if i == s.Cap()-1 {
+			i = 0
+		} else {
+			i++
+		}
+	}
+	return vals
+}
+
+func (s *KeyedStampBuffer[K]) Reset() {
+	var zero K
+	for i := range s.b {
+		s.b[i] = zero
+	}
+	s.r = 0
+	s.w = 0
+}
+
+func (s *KeyedStampBuffer[K]) incWritePosition() {
 	if s.w == s.Cap()-1 {
 		s.w = 0
 	} else {
@@ -65,7 +98,7 @@ func (s *StampBuffer) incWritePosition() {
 	}
 }
 
-func (s *StampBuffer) incReadPosition() {
+func (s *KeyedStampBuffer[K]) incReadPosition() {
 	if s.r == s.Cap()-1 {
 		s.r = 0
 	} else {
@@ -73,10 +106,10 @@ func (s *StampBuffer) incReadPosition() {
 	}
 }
 
-func (s *StampBuffer) Cap() int64 {
+func (s *KeyedStampBuffer[K]) Cap() int64 {
 	return int64(cap(s.b))
 }
 
-func (s *StampBuffer) IsEmpty() bool {
+func (s *KeyedStampBuffer[K]) IsEmpty() bool {
 	return s.r == s.w
 }
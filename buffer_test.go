@@ -21,3 +21,22 @@ func TestBuffer(t *testing.T) {
 		}
 	}
 }
+
+func TestBufferValues(t *testing.T) {
+	sb := NewStampBuffer(3)
+	if vals := sb.Values(); len(vals) != 0 {
+		t.Fatalf("expected no values, got %v", vals)
+	}
+
+	for i := 0; i < 5; i++ {
+		sb.PopIfFullThenPush(strconv.Itoa(i))
+	}
+	if vals := fmt.Sprint(sb.Values()); vals != "[3 4]" {
+		t.Fatalf("expected [3 4], got %s", vals)
+	}
+
+	sb.Reset()
+	if !sb.IsEmpty() {
+		t.Fatalf("expected empty buffer, got %s", sb)
+	}
+}
@@ -0,0 +1,267 @@
+package lampstamp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client is a Clock backed by a clock server. It keeps a small pool of
+// connections and is safe for concurrent use.
+type Client struct {
+	pool connPool
+}
+
+// Dial connects to the clock server at addr.
+func Dial(ctx context.Context, addr string) (*Client, error) {
+	c := &Client{pool: connPool{addr: addr}}
+	if _, err := c.Pipeline(ctx, Command{Op: opPing}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) GetCtx(ctx context.Context, key string) (int64, error) {
+	return c.do(ctx, Command{Op: OpGet, Key: key})
+}
+
+func (c *Client) IncCtx(ctx context.Context, key string) (int64, error) {
+	return c.do(ctx, Command{Op: OpInc, Key: key})
+}
+
+func (c *Client) TickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	return c.do(ctx, Command{Op: OpTick, Key: key, Timestamp: requestTimestamp})
+}
+
+func (c *Client) ValidateAndTickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	return c.do(ctx, Command{Op: OpValidateAndTick, Key: key, Timestamp: requestTimestamp})
+}
+
+func (c *Client) LeaseCtx(ctx context.Context, key string, min, n int64) (int64, error) {
+	return c.do(ctx, Command{Op: OpLease, Key: key, Timestamp: min, N: n})
+}
+
+func (c *Client) do(ctx context.Context, cmd Command) (int64, error) {
+	res, err := c.Pipeline(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	return res[0].Timestamp, res[0].Err
+}
+
+// Pipeline sends cmds without waiting for the replies in between and
+// returns one Result per command. The returned error reports a failure of
+// the connection; errors of single commands are in their Result.
+func (c *Client) Pipeline(ctx context.Context, cmds ...Command) ([]Result, error) {
+	return c.roundTrip(ctx, "", cmds)
+}
+
+// Batch is like Pipeline, but frames cmds as a single BATCH request.
+func (c *Client) Batch(ctx context.Context, cmds ...Command) ([]Result, error) {
+	if len(cmds) > maxBatch {
+		return nil, fmt.Errorf("%w: batch of %d commands exceeds %d", ErrProtocol, len(cmds), maxBatch)
+	}
+	return c.roundTrip(ctx, fmt.Sprintf("%s %d", opBatch, len(cmds)), cmds)
+}
+
+// maxInlinePipeline is the number of commands written before reading their
+// replies; their replies fit in the socket buffers.
+const maxInlinePipeline = 64
+
+func (c *Client) roundTrip(ctx context.Context, header string, cmds []Command) ([]Result, error) {
+	for _, cmd := range cmds {
+		switch cmd.Op {
+		case OpGet, OpInc, OpTick, OpValidateAndTick, OpLease, opPing:
+		default:
+			return nil, fmt.Errorf("%w: unknown command %q", ErrProtocol, cmd.Op)
+		}
+	}
+
+	results := make([]Result, len(cmds))
+	err := c.pool.do(ctx, func(cc *clientConn) error {
+		write := func() error {
+			if header != "" {
+				cc.w.WriteString(header + "\r\n")
+			}
+			for _, cmd := range cmds {
+				cc.w.WriteString(cmd.String() + "\r\n")
+			}
+			return cc.w.Flush()
+		}
+
+		// the server answers while it reads, so the replies to a long
+		// pipeline are read while it is written, or both sides could block
+		// on full socket buffers
+		written := make(chan error, 1)
+		if len(cmds) > maxInlinePipeline {
+			go func() { written <- write() }()
+		} else if err := write(); err != nil {
+			return err
+		} else {
+			written <- nil
+		}
+
+		for i, cmd := range cmds {
+			line, err := readLine(cc.r)
+			if err != nil {
+				return err
+			}
+			results[i] = parseReply(cmd, line)
+		}
+		return <-written
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Close closes the idle connections. Connections in use are closed when
+// their request completes.
+func (c *Client) Close() error {
+	return c.pool.Close()
+}
+
+// defaultMaxIdle is the number of idle connections a connPool keeps.
+const defaultMaxIdle = 8
+
+// connPool is a pool of connections to addr. dial, if set, replaces the
+// dialer, and init, if set, is called on every new connection.
+type connPool struct {
+	addr    string
+	dialer  net.Dialer
+	dial    func(ctx context.Context, addr string) (net.Conn, error)
+	init    func(cc *clientConn) error
+	maxIdle int
+
+	mu     sync.Mutex
+	idle   []*clientConn
+	closed bool
+}
+
+type clientConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// do calls fn with a pooled connection, bounded by the deadline and
+// cancellation of ctx. A connection fn fails on is closed instead of being
+// returned to the pool, as its stream may be out of sync.
+func (p *connPool) do(ctx context.Context, fn func(cc *clientConn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	cc, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := cc.watch(ctx, fn); err != nil {
+		cc.conn.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the connection deadline may fire before the context does
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+	p.put(cc)
+	return nil
+}
+
+func (cc *clientConn) watch(ctx context.Context, fn func(cc *clientConn) error) error {
+	deadline, _ := ctx.Deadline()
+	if err := cc.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	if ctx.Done() != nil {
+		stop, exited := make(chan struct{}), make(chan struct{})
+		defer func() {
+			close(stop)
+			<-exited
+		}()
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				// unblock the pending read or write
+				cc.conn.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+	}
+	return fn(cc)
+}
+
+func (p *connPool) get(ctx context.Context) (*clientConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(p.idle); n > 0 {
+		cc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return cc, nil
+	}
+	p.mu.Unlock()
+
+	dial := p.dial
+	if dial == nil {
+		dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return p.dialer.DialContext(ctx, "tcp", addr)
+		}
+	}
+	conn, err := dial(ctx, p.addr)
+	if err != nil {
+		return nil, err
+	}
+	cc := &clientConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if p.init != nil {
+		if err := cc.watch(ctx, p.init); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return cc, nil
+}
+
+func (p *connPool) put(cc *clientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	maxIdle := p.maxIdle
+	if maxIdle == 0 {
+		maxIdle = defaultMaxIdle
+	}
+	if p.closed || len(p.idle) >= maxIdle {
+		cc.conn.Close()
+		return
+	}
+	p.idle = append(p.idle, cc)
+}
+
+func (p *connPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, cc := range p.idle {
+		cc.conn.Close()
+	}
+	p.idle = nil
+	return nil
+}
+
+var (
+	_ Clock  = (*Client)(nil)
+	_ Leaser = (*Client)(nil)
+)
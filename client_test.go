@@ -0,0 +1,216 @@
+package lampstamp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dialTestClient(t *testing.T, clock Clock) *Client {
+	t.Helper()
+
+	c, err := Dial(context.Background(), startTestServer(t, clock))
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient(t *testing.T) {
+	lt := NewLampstamp()
+	c := dialTestClient(t, lt)
+	ctx := context.Background()
+
+	ts, err := c.IncCtx(ctx, "msg-id-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), ts)
+
+	ts, err = c.TickCtx(ctx, "msg-id-1", 5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), ts)
+
+	ts, err = c.ValidateAndTickCtx(ctx, "msg-id-1", 3)
+	assert.ErrorIs(t, err, ErrStale)
+	var stale *StaleError
+	require.ErrorAs(t, err, &stale)
+	assert.Equal(t, StaleError{Key: "msg-id-1", Request: 3, Current: 6}, *stale)
+	assert.Equal(t, int64(6), ts)
+
+	ts, err = c.ValidateAndTickCtx(ctx, "msg-id-1", 6)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), ts)
+
+	ts, err = c.LeaseCtx(ctx, "msg-id-1", 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(17), ts)
+
+	ts, err = c.GetCtx(ctx, "msg-id 1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), ts)
+
+	// the state lives in the server's clock
+	assert.Equal(t, int64(17), lt.Get("msg-id-1"))
+}
+
+func TestClientPipelineAndBatch(t *testing.T) {
+	c := dialTestClient(t, NewLampstamp())
+	ctx := context.Background()
+
+	cmds := []Command{
+		{Op: OpInc, Key: "msg-id-1"},
+		{Op: OpTick, Key: "msg-id-2", Timestamp: 9},
+		{Op: OpValidateAndTick, Key: "msg-id-2", Timestamp: 1},
+		{Op: OpGet, Key: "msg-id-1"},
+	}
+	for name, send := range map[string]func(context.Context, ...Command) ([]Result, error){
+		"Pipeline": c.Pipeline,
+		"Batch":    c.Batch,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c.TickCtx(ctx, "msg-id-1", 0)
+
+			results, err := send(ctx, cmds...)
+			require.NoError(t, err)
+			require.Len(t, results, len(cmds))
+
+			inc := results[0].Timestamp
+			assert.NoError(t, results[0].Err)
+			assert.NoError(t, results[1].Err)
+			assert.ErrorIs(t, results[2].Err, ErrStale)
+			assert.Equal(t, results[1].Timestamp, results[2].Timestamp)
+			assert.Equal(t, Result{Timestamp: inc}, results[3])
+		})
+	}
+
+	_, err := c.Pipeline(ctx, Command{Op: "FROB"})
+	assert.ErrorIs(t, err, ErrProtocol)
+
+	results, err := c.Batch(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestClientServerError(t *testing.T) {
+	errLoad := errors.New("storage is down")
+	c := dialTestClient(t, NewLampstamp(WithLoader(func(ctx context.Context, key string) (int64, error) {
+		return 0, errLoad
+	})))
+
+	_, err := c.IncCtx(context.Background(), "msg-id-1")
+	var serr *ServerError
+	require.ErrorAs(t, err, &serr)
+	assert.Contains(t, serr.Message, errLoad.Error())
+}
+
+func TestClientContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// a server that accepts connections but never answers
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := &Client{pool: connPool{addr: l.Addr().String()}}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.IncCtx(ctx, "msg-id-1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = c.IncCtx(ctx, "msg-id-1")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = c.IncCtx(ctx, "msg-id-1")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestClientConcurrent(t *testing.T) {
+	lt := NewLampstamp()
+	c := dialTestClient(t, lt)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := c.IncCtx(context.Background(), "msg-id-1")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(800), lt.Get("msg-id-1"))
+
+	c.Close()
+	_, err := c.IncCtx(context.Background(), "msg-id-1")
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func BenchmarkClientTick(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	srv := &Server{Clock: NewLampstamp()}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c, err := Dial(context.Background(), l.Addr().String())
+	require.NoError(b, err)
+	defer c.Close()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c.TickCtx(context.Background(), fmt.Sprint(i%1000), int64(i))
+			i++
+		}
+	})
+}
+
+// verboseClock fails every tick with its key as the error, so that replies
+// are as long as requests.
+type verboseClock struct {
+	Clock
+}
+
+func (verboseClock) TickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	return 0, errors.New(key)
+}
+
+func TestClientLargeBatch(t *testing.T) {
+	c := dialTestClient(t, verboseClock{NewLampstamp()})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// replies arrive while the requests are still being written, so a
+	// batch whose replies overflow the socket buffers must not block
+	cmds := make([]Command, maxBatch)
+	for i := range cmds {
+		cmds[i] = Command{Op: OpTick, Key: fmt.Sprintf("%0512d", i), Timestamp: 1}
+	}
+	for _, roundTrip := range []func(context.Context, ...Command) ([]Result, error){c.Batch, c.Pipeline} {
+		results, err := roundTrip(ctx, cmds...)
+		require.NoError(t, err)
+		require.Len(t, results, len(cmds))
+		var serr *ServerError
+		assert.ErrorAs(t, results[len(results)-1].Err, &serr)
+	}
+}
@@ -0,0 +1,89 @@
+package lampstamp
+
+import "context"
+
+// Clock is a per-key logical clock. It is implemented by the in-process
+// Lampstamp and by backends that persist or share counters, which is why
+// every operation takes a context and may fail.
+type Clock interface {
+	GetCtx(ctx context.Context, key string) (int64, error)
+	IncCtx(ctx context.Context, key string) (int64, error)
+	TickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error)
+	// ValidateAndTickCtx atomically rejects a requestTimestamp lower than
+	// the current counter with a *StaleError, and ticks otherwise.
+	ValidateAndTickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error)
+}
+
+var (
+	_ Clock  = (*Lampstamp)(nil)
+	_ Clock  = (*ShardedLampstamp)(nil)
+	_ Leaser = (*Lampstamp)(nil)
+	_ Leaser = (*ShardedLampstamp)(nil)
+)
+
+func (ts *KeyedLampstamp[K]) GetCtx(ctx context.Context, key K) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return ts.get(ctx, key)
+}
+
+func (ts *KeyedLampstamp[K]) IncCtx(ctx context.Context, key K) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	if err := ts.seed(ctx, key); err != nil {
+		return defaultTimestamp, err
+	}
+	return ts.inc(key), nil
+}
+
+func (ts *KeyedLampstamp[K]) TickCtx(ctx context.Context, key K, requestTimestamp int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	if err := ts.seed(ctx, key); err != nil {
+		return defaultTimestamp, err
+	}
+	return ts.tick(key, requestTimestamp), nil
+}
+
+func (ts *KeyedLampstamp[K]) ValidateAndTickCtx(ctx context.Context, key K, requestTimestamp int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	if err := ts.seed(ctx, key); err != nil {
+		return defaultTimestamp, err
+	}
+	return ts.validateAndTick(key, requestTimestamp)
+}
+
+func (ts *KeyedLampstamp[K]) LeaseCtx(ctx context.Context, key K, min, n int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	if err := ts.seed(ctx, key); err != nil {
+		return defaultTimestamp, err
+	}
+	return ts.lease(key, min, n), nil
+}
+
+func (s *ShardedLampstamp) GetCtx(ctx context.Context, key string) (int64, error) {
+	return s.shard(key).GetCtx(ctx, key)
+}
+
+func (s *ShardedLampstamp) IncCtx(ctx context.Context, key string) (int64, error) {
+	return s.shard(key).IncCtx(ctx, key)
+}
+
+func (s *ShardedLampstamp) TickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	return s.shard(key).TickCtx(ctx, key, requestTimestamp)
+}
+
+func (s *ShardedLampstamp) ValidateAndTickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	return s.shard(key).ValidateAndTickCtx(ctx, key, requestTimestamp)
+}
+
+func (s *ShardedLampstamp) LeaseCtx(ctx context.Context, key string, min, n int64) (int64, error) {
+	return s.shard(key).LeaseCtx(ctx, key, min, n)
+}
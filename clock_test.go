@@ -0,0 +1,59 @@
+package lampstamp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testClocks() map[string]Clock {
+	return map[string]Clock{
+		"lampstamp": NewLampstamp(),
+		"sharded":   NewShardedLampstamp(4, 1024),
+	}
+}
+
+func TestClock(t *testing.T) {
+	for name, c := range testClocks() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			val, err := c.GetCtx(ctx, "a")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 0, val)
+
+			val, err = c.IncCtx(ctx, "a")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, val)
+
+			val, err = c.TickCtx(ctx, "a", 5)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 6, val)
+
+			val, err = c.GetCtx(ctx, "a")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 6, val)
+		})
+	}
+}
+
+func TestClockCanceled(t *testing.T) {
+	for name, c := range testClocks() {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := c.IncCtx(ctx, "a")
+			assert.ErrorIs(t, err, context.Canceled)
+			_, err = c.TickCtx(ctx, "a", 1)
+			assert.ErrorIs(t, err, context.Canceled)
+			_, err = c.GetCtx(ctx, "a")
+			assert.ErrorIs(t, err, context.Canceled)
+
+			val, err := c.GetCtx(context.Background(), "a")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 0, val)
+		})
+	}
+}
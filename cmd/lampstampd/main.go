@@ -0,0 +1,130 @@
+// Command lampstampd serves a Lampstamp over TCP so that several API
+// servers share one clock per key.
+//
+//	lampstampd -addr :7878 -dir /var/lib/lampstampd
+//
+// See lampstamp.Server for the protocol and lampstamp.Client for a Go
+// client. The server also speaks RESP, so any Redis client can call
+// LGET, LINC, LTICK and LCAS:
+//
+//	redis-cli -p 7878 LTICK msg-id-1 57
+//
+// With -peers, the clock is replicated over a group of lampstampd nodes
+// that elect a leader among themselves and talk to each other on
+// -raft-addr. Ticks survive the loss of any minority of the nodes:
+//
+//	lampstampd -dir /var/lib/lampstampd -raft-addr 10.0.0.1:7879 \
+//		-peers 10.0.0.1:7879,10.0.0.2:7879,10.0.0.3:7879
+//
+// Nodes drop connections to -raft-addr from hosts not in -peers, but their
+// traffic is not encrypted and a node accepts whatever log its leader
+// sends: -raft-addr must be on a private network. Set the same secret in
+// LAMPSTAMPD_RAFT_SECRET on every node so that nodes authenticate each
+// other as well.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/wonksing/lampstamp"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+// run serves until SIGINT or SIGTERM and returns the exit code. Failures
+// return rather than exit, so that the deferred Close flushes the log.
+func run() int {
+	addr := flag.String("addr", ":7878", "address to listen on")
+	size := flag.Int64("size", 1<<20, "maximum number of keys kept in memory")
+	shards := flag.Int("shards", 0, "number of shards of an in-memory clock, 0 for one")
+	dir := flag.String("dir", "", "directory of the write-ahead log; the clock is in-memory only if empty")
+	syncAlways := flag.Bool("sync", true, "fsync every tick before answering it")
+	raftAddr := flag.String("raft-addr", "", "address this node is reached at by its peers, one of -peers")
+	peers := flag.String("peers", "", "comma separated -raft-addr of every node of a replicated group")
+	flag.Parse()
+
+	newEvictor := func(size int64) lampstamp.Evictor {
+		return lampstamp.NewLRUEvictor(int(size))
+	}
+	opts := []lampstamp.Option{lampstamp.WithEvictor(newEvictor(*size))}
+
+	var clock lampstamp.Clock
+	switch {
+	case *peers != "":
+		if *dir == "" || *raftAddr == "" {
+			log.Println("-peers requires -dir and -raft-addr")
+			return 2
+		}
+		rl, err := net.Listen("tcp", *raftAddr)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		r, err := lampstamp.OpenReplicated(rl, lampstamp.ReplicatedOptions{
+			ID:     *raftAddr,
+			Peers:  strings.Split(*peers, ","),
+			Dir:    *dir,
+			Secret: os.Getenv("LAMPSTAMPD_RAFT_SECRET"),
+		}, opts...)
+		if err != nil {
+			rl.Close()
+			log.Println(err)
+			return 1
+		}
+		defer closeClock(r)
+		clock = r
+	case *dir != "":
+		do := lampstamp.DurableOptions{Sync: lampstamp.SyncBatch}
+		if !*syncAlways {
+			do.Sync = lampstamp.SyncInterval
+		}
+		d, err := lampstamp.OpenDurable(*dir, do, opts...)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer closeClock(d)
+		clock = d
+	case *shards > 1:
+		clock = lampstamp.NewShardedLampstampEvictor(*shards, *size, newEvictor)
+	default:
+		clock = lampstamp.NewLampstamp(opts...)
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("lampstampd listening on %s", l.Addr())
+
+	srv := &lampstamp.Server{Clock: clock}
+	defer srv.Close()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && err != lampstamp.ErrServerClosed {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func closeClock(c io.Closer) {
+	if err := c.Close(); err != nil {
+		log.Println(err)
+	}
+}
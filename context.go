@@ -0,0 +1,74 @@
+package lampstamp
+
+import (
+	"context"
+	"errors"
+)
+
+type timestampContextKey struct{}
+
+type contextTimestamp struct {
+	key string
+	ts  int64
+}
+
+var ErrNoTimestamp = errors.New("no timestamp in context")
+
+// ContextWithTimestamp returns a copy of ctx carrying key and its
+// timestamp, so that causal metadata flows with a request instead of
+// through every function signature.
+func ContextWithTimestamp(ctx context.Context, key string, ts int64) context.Context {
+	return context.WithValue(ctx, timestampContextKey{}, contextTimestamp{key, ts})
+}
+
+// FromContext returns the key and timestamp attached to ctx.
+func FromContext(ctx context.Context) (key string, ts int64, ok bool) {
+	v, ok := ctx.Value(timestampContextKey{}).(contextTimestamp)
+	return v.key, v.ts, ok
+}
+
+// TimestampFromContext returns the timestamp attached to ctx, such as the
+// one issued by Middleware for the current request.
+func TimestampFromContext(ctx context.Context) (int64, bool) {
+	_, ts, ok := FromContext(ctx)
+	return ts, ok
+}
+
+// IncContext increments key on c and returns a context carrying the new
+// timestamp, ready to be injected into an outgoing message.
+func IncContext(ctx context.Context, c Clock, key string) (context.Context, int64, error) {
+	ts, err := c.IncCtx(ctx, key)
+	if err != nil {
+		return ctx, ts, err
+	}
+	return ContextWithTimestamp(ctx, key, ts), ts, nil
+}
+
+// TickContext ticks c with the key and timestamp attached to ctx, such as
+// those extracted from an incoming message, and returns a context carrying
+// the new timestamp.
+func TickContext(ctx context.Context, c Clock) (context.Context, int64, error) {
+	key, ts, ok := FromContext(ctx)
+	if !ok {
+		return ctx, defaultTimestamp, ErrNoTimestamp
+	}
+	ts, err := c.TickCtx(ctx, key, ts)
+	if err != nil {
+		return ctx, ts, err
+	}
+	return ContextWithTimestamp(ctx, key, ts), ts, nil
+}
+
+// ValidateAndTickContext is TickContext rejecting stale timestamps like
+// Clock.ValidateAndTickCtx.
+func ValidateAndTickContext(ctx context.Context, c Clock) (context.Context, int64, error) {
+	key, ts, ok := FromContext(ctx)
+	if !ok {
+		return ctx, defaultTimestamp, ErrNoTimestamp
+	}
+	ts, err := c.ValidateAndTickCtx(ctx, key, ts)
+	if err != nil {
+		return ctx, ts, err
+	}
+	return ContextWithTimestamp(ctx, key, ts), ts, nil
+}
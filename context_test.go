@@ -0,0 +1,70 @@
+package lampstamp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextWithTimestamp(t *testing.T) {
+	ctx := context.Background()
+	_, _, ok := FromContext(ctx)
+	assert.False(t, ok)
+
+	ctx = ContextWithTimestamp(ctx, "msg-id-1", 3)
+	key, ts, ok := FromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "msg-id-1", key)
+	assert.EqualValues(t, 3, ts)
+
+	ts, ok = TimestampFromContext(ctx)
+	assert.True(t, ok)
+	assert.EqualValues(t, 3, ts)
+}
+
+func TestIncAndTickContext(t *testing.T) {
+	client := NewLampstamp()
+	server := NewLampstamp()
+
+	// the client stamps an outgoing message
+	ctx, ts, err := IncContext(context.Background(), client, "msg-id-1")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, ts)
+
+	carrier := MapCarrier{}
+	TextMapPropagator{}.Inject(ctx, carrier)
+
+	// the server ticks with what it received
+	serverCtx := TextMapPropagator{}.Extract(context.Background(), carrier)
+	serverCtx, ts, err = ValidateAndTickContext(serverCtx, server)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, ts)
+
+	_, ts, err = TickContext(serverCtx, client)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, ts)
+
+	_, _, err = ValidateAndTickContext(ctx, server)
+	assert.ErrorIs(t, err, ErrStale)
+
+	_, _, err = TickContext(context.Background(), client)
+	assert.ErrorIs(t, err, ErrNoTimestamp)
+	_, _, err = ValidateAndTickContext(context.Background(), client)
+	assert.ErrorIs(t, err, ErrNoTimestamp)
+}
+
+func TestContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	c := NewLampstamp()
+	_, _, err := IncContext(ctx, c, "msg-id-1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, _, err = TickContext(ContextWithTimestamp(ctx, "msg-id-1", 1), c)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.EqualValues(t, 0, c.Get("msg-id-1"))
+}
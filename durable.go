@@ -0,0 +1,550 @@
+package lampstamp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs every record before its timestamp is returned.
+	SyncAlways SyncPolicy = iota
+	// SyncBatch lets concurrent callers share a single fsync. Every
+	// timestamp is still durable before it is returned.
+	SyncBatch
+	// SyncInterval fsyncs in the background every SyncInterval. Timestamps
+	// issued since the last fsync can be lost on a crash.
+	SyncInterval
+)
+
+type DurableOptions struct {
+	Sync SyncPolicy
+	// SyncInterval is the fsync period of SyncInterval, 100ms by default.
+	SyncInterval time.Duration
+	// SegmentSize is the size at which a new log segment is started,
+	// 64MiB by default.
+	SegmentSize int64
+	// CompactInterval is the period of background compaction into a
+	// snapshot. Zero disables it, Compact can still be called directly.
+	CompactInterval time.Duration
+}
+
+const (
+	walSuffix      = ".wal"
+	snapshotSuffix = ".snap"
+
+	defaultSyncInterval = 100 * time.Millisecond
+	defaultSegmentSize  = 64 << 20
+)
+
+var (
+	ErrClosed     = errors.New("clock is closed")
+	ErrWALCorrupt = errors.New("write-ahead log is corrupt")
+)
+
+// DurableLampstamp is a Lampstamp whose ticks are appended to a segmented
+// write-ahead log in dir. Opening it replays the latest snapshot and every
+// segment after it, so a restarted process never issues a timestamp it
+// already issued before crashing.
+//
+// The log holds one record per tick: len(key) | key | counter | crc32.
+// Segment and snapshot files are named after their sequence number; a
+// snapshot covers every segment with a lower number.
+type DurableLampstamp struct {
+	ts   *Lampstamp
+	dir  string
+	opts DurableOptions
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	f       *os.File
+	seg     uint64
+	size    int64
+	written uint64
+	synced  uint64
+	syncing bool
+	closed  bool
+
+	compactMu sync.Mutex
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+var (
+	_ Clock  = (*DurableLampstamp)(nil)
+	_ Leaser = (*DurableLampstamp)(nil)
+)
+
+func OpenDurable(dir string, do DurableOptions, opts ...Option) (*DurableLampstamp, error) {
+	if do.SyncInterval <= 0 {
+		do.SyncInterval = defaultSyncInterval
+	}
+	if do.SegmentSize <= 0 {
+		do.SegmentSize = defaultSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	d := &DurableLampstamp{
+		ts:   NewLampstamp(opts...),
+		dir:  dir,
+		opts: do,
+		done: make(chan struct{}),
+	}
+	d.cond = sync.NewCond(&d.mu)
+
+	last, err := d.replay()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.openSegment(last + 1); err != nil {
+		return nil, err
+	}
+
+	if do.Sync == SyncInterval {
+		d.wg.Add(1)
+		go d.every(do.SyncInterval, d.Sync)
+	}
+	if do.CompactInterval > 0 {
+		d.wg.Add(1)
+		go d.every(do.CompactInterval, d.Compact)
+	}
+
+	return d, nil
+}
+
+func (d *DurableLampstamp) Get(key string) int64 {
+	return d.ts.Get(key)
+}
+
+func (d *DurableLampstamp) Inc(key string) (int64, error) {
+	val := d.ts.Inc(key)
+	return val, d.append(key, val)
+}
+
+func (d *DurableLampstamp) Tick(key string, requestTimestamp int64) (int64, error) {
+	val := d.ts.Tick(key, requestTimestamp)
+	return val, d.append(key, val)
+}
+
+func (d *DurableLampstamp) ValidateAndTick(key string, requestTimestamp int64) (int64, error) {
+	val, err := d.ts.ValidateAndTick(key, requestTimestamp)
+	if err != nil {
+		return val, err
+	}
+	return val, d.append(key, val)
+}
+
+func (d *DurableLampstamp) Lease(key string, min, n int64) (int64, error) {
+	val := d.ts.Lease(key, min, n)
+	return val, d.append(key, val)
+}
+
+func (d *DurableLampstamp) GetCtx(ctx context.Context, key string) (int64, error) {
+	return d.ts.GetCtx(ctx, key)
+}
+
+func (d *DurableLampstamp) IncCtx(ctx context.Context, key string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return d.Inc(key)
+}
+
+func (d *DurableLampstamp) TickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return d.Tick(key, requestTimestamp)
+}
+
+func (d *DurableLampstamp) ValidateAndTickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return d.ValidateAndTick(key, requestTimestamp)
+}
+
+func (d *DurableLampstamp) LeaseCtx(ctx context.Context, key string, min, n int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return d.Lease(key, min, n)
+}
+
+// append logs a tick and, unless the policy is SyncInterval, returns once
+// it is on disk.
+func (d *DurableLampstamp) append(key string, val int64) error {
+	rec := encodeWALRecord(key, val)
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrClosed
+	}
+	if _, err := d.f.Write(rec); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	d.size += int64(len(rec))
+	d.written++
+	seq := d.written
+
+	var err error
+	if d.opts.Sync == SyncAlways {
+		err = d.syncLocked()
+	}
+	if err == nil && d.size >= d.opts.SegmentSize {
+		err = d.rotateLocked()
+	}
+	d.mu.Unlock()
+
+	if err != nil || d.opts.Sync != SyncBatch {
+		return err
+	}
+	return d.waitSynced(seq)
+}
+
+// waitSynced blocks until record seq is on disk. The first waiter fsyncs
+// on behalf of everyone who appended before it started.
+func (d *DurableLampstamp) waitSynced(seq uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.synced < seq {
+		if d.syncing {
+			d.cond.Wait()
+			continue
+		}
+		if d.closed {
+			return ErrClosed
+		}
+
+		d.syncing = true
+		f, target := d.f, d.written
+		d.mu.Unlock()
+		err := f.Sync()
+		d.mu.Lock()
+		d.syncing = false
+		if err == nil && target > d.synced {
+			d.synced = target
+		}
+		d.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync flushes the current segment to disk.
+func (d *DurableLampstamp) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+	return d.syncLocked()
+}
+
+func (d *DurableLampstamp) syncLocked() error {
+	for d.syncing {
+		d.cond.Wait()
+	}
+	if d.synced == d.written {
+		return nil
+	}
+	if err := d.f.Sync(); err != nil {
+		return err
+	}
+	d.synced = d.written
+	return nil
+}
+
+func (d *DurableLampstamp) rotateLocked() error {
+	if err := d.syncLocked(); err != nil {
+		return err
+	}
+	if err := d.f.Close(); err != nil {
+		return err
+	}
+	return d.openSegment(d.seg + 1)
+}
+
+func (d *DurableLampstamp) openSegment(seg uint64) error {
+	f, err := os.OpenFile(d.path(seg, walSuffix), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(d.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	d.f = f
+	d.seg = seg
+	d.size = 0
+	return nil
+}
+
+// Compact writes a snapshot of the clock and removes the segments and
+// snapshots it supersedes.
+func (d *DurableLampstamp) Compact() error {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrClosed
+	}
+	// every record in the segments before the new one has already been
+	// applied to d.ts, so the snapshot taken below covers them
+	err := d.rotateLocked()
+	seg := d.seg
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := d.ts.Snapshot(&buf); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(d.path(seg, snapshotSuffix), buf.Bytes()); err != nil {
+		return err
+	}
+
+	segs, snaps, err := d.list()
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if s < seg {
+			os.Remove(d.path(s, walSuffix))
+		}
+	}
+	for _, s := range snaps {
+		if s < seg {
+			os.Remove(d.path(s, snapshotSuffix))
+		}
+	}
+	return nil
+}
+
+func (d *DurableLampstamp) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrClosed
+	}
+	err := d.syncLocked()
+	d.closed = true
+	if cerr := d.f.Close(); err == nil {
+		err = cerr
+	}
+	d.cond.Broadcast()
+	d.mu.Unlock()
+
+	close(d.done)
+	d.wg.Wait()
+	return err
+}
+
+func (d *DurableLampstamp) every(interval time.Duration, fn func() error) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// replay loads the latest snapshot and the segments after it, and returns
+// the number of the last segment seen.
+func (d *DurableLampstamp) replay() (uint64, error) {
+	segs, snaps, err := d.list()
+	if err != nil {
+		return 0, err
+	}
+
+	var last uint64
+	if len(snaps) > 0 {
+		last = snaps[len(snaps)-1]
+		f, err := os.Open(d.path(last, snapshotSuffix))
+		if err != nil {
+			return 0, err
+		}
+		err = d.ts.Restore(f)
+		f.Close()
+		if err != nil {
+			return 0, fmt.Errorf("restore %s: %w", d.path(last, snapshotSuffix), err)
+		}
+	}
+
+	for i, seg := range segs {
+		if seg < last {
+			continue
+		}
+		if err := d.replaySegment(seg, i == len(segs)-1); err != nil {
+			return 0, err
+		}
+		last = seg
+	}
+	return last, nil
+}
+
+// replaySegment applies every record of a segment. A torn record at the end
+// of the last segment is what a crash mid-append leaves behind and is cut
+// off; anywhere else it means the log is corrupt.
+func (d *DurableLampstamp) replaySegment(seg uint64, isLast bool) error {
+	path := d.path(seg, walSuffix)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	off := 0
+	for off < len(data) {
+		key, val, n, err := decodeWALRecord(data[off:])
+		if err != nil {
+			if !isLast || hasWALRecord(data[off+1:]) {
+				return fmt.Errorf("%w: %s at offset %d", ErrWALCorrupt, path, off)
+			}
+			return os.Truncate(path, int64(off))
+		}
+		d.ts.advance(key, val)
+		off += n
+	}
+	return nil
+}
+
+func (d *DurableLampstamp) list() (segs, snaps []uint64, err error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		for _, suffix := range []string{walSuffix, snapshotSuffix} {
+			if !strings.HasSuffix(name, suffix) {
+				continue
+			}
+			n, err := strconv.ParseUint(strings.TrimSuffix(name, suffix), 10, 64)
+			if err != nil {
+				continue
+			}
+			if suffix == walSuffix {
+				segs = append(segs, n)
+			} else {
+				snaps = append(snaps, n)
+			}
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i] < snaps[j] })
+	return segs, snaps, nil
+}
+
+func (d *DurableLampstamp) path(seg uint64, suffix string) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%020d%s", seg, suffix))
+}
+
+func encodeWALRecord(key string, val int64) []byte {
+	var buf bytes.Buffer
+	writeString(&buf, key)
+	writeVarint(&buf, val)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+func decodeWALRecord(data []byte) (key string, val int64, n int, err error) {
+	r := bytes.NewReader(data)
+	if key, err = readString(r); err != nil {
+		return "", 0, 0, ErrWALCorrupt
+	}
+	if val, err = binary.ReadVarint(r); err != nil {
+		return "", 0, 0, ErrWALCorrupt
+	}
+	n = len(data) - r.Len()
+
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return "", 0, 0, ErrWALCorrupt
+	}
+	if binary.BigEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(data[:n]) {
+		return "", 0, 0, ErrWALCorrupt
+	}
+	return key, val, n + len(sum), nil
+}
+
+// hasWALRecord reports whether a valid record starts anywhere in data. A
+// bad record followed by valid ones was damaged after it was written, while
+// one followed by none is the torn tail of a crash.
+func hasWALRecord(data []byte) bool {
+	for off := range data {
+		if _, _, _, err := decodeWALRecord(data[off:]); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileAtomic replaces path with data so that a crash leaves either
+// the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
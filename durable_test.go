@@ -0,0 +1,262 @@
+package lampstamp
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crashCopy copies the files of a durable clock as they are on disk, which
+// is what a process that crashed right now would find when restarting.
+func crashCopy(t *testing.T, dir string) string {
+	dst := t.TempDir()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dst, entry.Name()), data, 0o644))
+	}
+	return dst
+}
+
+func TestDurableLampstampReopen(t *testing.T) {
+	policies := map[string]SyncPolicy{
+		"always":   SyncAlways,
+		"batch":    SyncBatch,
+		"interval": SyncInterval,
+	}
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			d, err := OpenDurable(dir, DurableOptions{Sync: policy})
+			require.NoError(t, err)
+
+			val, err := d.Inc("a")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, val)
+			val, err = d.Tick("a", 10)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 11, val)
+			_, err = d.ValidateAndTick("b", 3)
+			assert.NoError(t, err)
+			_, err = d.ValidateAndTick("b", 0)
+			assert.ErrorIs(t, err, ErrStale)
+			val, err = d.Lease("c", 5, 10)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 15, val)
+			require.NoError(t, d.Close())
+
+			_, err = d.Inc("a")
+			assert.ErrorIs(t, err, ErrClosed)
+
+			d, err = OpenDurable(dir, DurableOptions{Sync: policy})
+			require.NoError(t, err)
+			defer d.Close()
+			assert.EqualValues(t, 11, d.Get("a"))
+			assert.EqualValues(t, 4, d.Get("b"))
+			assert.EqualValues(t, 15, d.Get("c"))
+			val, err = d.Inc("a")
+			assert.NoError(t, err)
+			assert.EqualValues(t, 12, val)
+		})
+	}
+}
+
+func TestDurableLampstampCrash(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncBatch} {
+		dir := t.TempDir()
+		d, err := OpenDurable(dir, DurableOptions{Sync: policy, SegmentSize: 64})
+		require.NoError(t, err)
+		defer d.Close()
+
+		issued := make(map[string]int64)
+		for i := 0; i < 100; i++ {
+			key := strconv.Itoa(i % 7)
+			val, err := d.Tick(key, int64(i))
+			require.NoError(t, err)
+			issued[key] = val
+		}
+
+		crashed := crashCopy(t, dir)
+		restarted, err := OpenDurable(crashed, DurableOptions{})
+		require.NoError(t, err)
+		for key, val := range issued {
+			assert.GreaterOrEqual(t, restarted.Get(key), val)
+		}
+		restarted.Close()
+	}
+}
+
+func TestDurableLampstampCorruptTail(t *testing.T) {
+	dir := t.TempDir()
+	d, err := OpenDurable(dir, DurableOptions{})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := d.Tick(strconv.Itoa(i), int64(i*100))
+		require.NoError(t, err)
+	}
+
+	crashed := crashCopy(t, dir)
+	segs, _, err := d.list()
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	// a damaged record followed by valid ones is not a torn tail, and
+	// cutting the segment there would lose the ticks after it
+	path := filepath.Join(crashed, filepath.Base(d.path(segs[len(segs)-1], walSuffix)))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)/3] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	_, err = OpenDurable(crashed, DurableOptions{})
+	assert.ErrorIs(t, err, ErrWALCorrupt)
+}
+
+func TestDurableLampstampTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	d, err := OpenDurable(dir, DurableOptions{})
+	require.NoError(t, err)
+	_, err = d.Tick("a", 5)
+	require.NoError(t, err)
+
+	crashed := crashCopy(t, dir)
+	segs, _, err := d.list()
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	rec := encodeWALRecord("b", 100)
+	path := filepath.Join(crashed, filepath.Base(d.path(segs[len(segs)-1], walSuffix)))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write(rec[:len(rec)-1])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	restarted, err := OpenDurable(crashed, DurableOptions{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, restarted.Get("a"))
+	assert.EqualValues(t, 0, restarted.Get("b"))
+	require.NoError(t, restarted.Close())
+
+	// the torn record was cut off, so the segment is no longer corrupt
+	// once it is not the last one
+	restarted, err = OpenDurable(crashed, DurableOptions{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, restarted.Get("a"))
+	require.NoError(t, restarted.Close())
+}
+
+func TestDurableLampstampCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	d, err := OpenDurable(dir, DurableOptions{SegmentSize: 16})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := d.Inc("key")
+		require.NoError(t, err)
+	}
+	segs, _, err := d.list()
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	require.Greater(t, len(segs), 2)
+
+	path := d.path(segs[0], walSuffix)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	_, err = OpenDurable(dir, DurableOptions{})
+	assert.ErrorIs(t, err, ErrWALCorrupt)
+}
+
+func TestDurableLampstampCompact(t *testing.T) {
+	dir := t.TempDir()
+	d, err := OpenDurable(dir, DurableOptions{SegmentSize: 32}, WithEvictor(NewLRUEvictor(4)))
+	require.NoError(t, err)
+
+	issued := make(map[string]int64)
+	for i := 0; i < 50; i++ {
+		key := strconv.Itoa(i % 10)
+		val, err := d.Inc(key)
+		require.NoError(t, err)
+		issued[key] = val
+	}
+	require.NoError(t, d.Compact())
+
+	segs, snaps, err := d.list()
+	require.NoError(t, err)
+	assert.Len(t, snaps, 1)
+	assert.Len(t, segs, 1)
+	assert.Equal(t, snaps[0], segs[0])
+
+	val, err := d.Inc("0")
+	require.NoError(t, err)
+	issued["0"] = val
+	require.NoError(t, d.Close())
+
+	d, err = OpenDurable(dir, DurableOptions{}, WithEvictor(NewLRUEvictor(4)))
+	require.NoError(t, err)
+	defer d.Close()
+	for key, val := range issued {
+		assert.GreaterOrEqual(t, d.Get(key), val)
+	}
+}
+
+func TestDurableLampstampBackgroundCompact(t *testing.T) {
+	dir := t.TempDir()
+	d, err := OpenDurable(dir, DurableOptions{
+		Sync:            SyncInterval,
+		SyncInterval:    time.Millisecond,
+		CompactInterval: 5 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer d.Close()
+
+	_, err = d.Tick("a", 41)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, snaps, err := d.list()
+		return err == nil && len(snaps) > 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestDurableLampstampConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	d, err := OpenDurable(dir, DurableOptions{Sync: SyncBatch, SegmentSize: 256})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, err := d.Inc("a")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, d.Compact())
+		}
+	}()
+	wg.Wait()
+	require.NoError(t, d.Close())
+
+	d, err = OpenDurable(dir, DurableOptions{})
+	require.NoError(t, err)
+	defer d.Close()
+	assert.EqualValues(t, 800, d.Get("a"))
+}
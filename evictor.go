@@ -0,0 +1,294 @@
+package lampstamp
+
+import (
+	"container/heap"
+	"container/list"
+	"sort"
+	"time"
+)
+
+// KeyedEvictor decides which keys a clock forgets once it is full. Clocks
+// call it while holding their write lock, so implementations do not need
+// to be safe for concurrent use.
+type KeyedEvictor[K comparable] interface {
+	// Add registers a key that is new to the clock and returns the keys
+	// that have to be evicted to make room for it.
+	Add(key K) []K
+	// Touch marks a key already known to the clock as ticked.
+	Touch(key K)
+	// Keys returns the keys held, in the order they would be evicted.
+	Keys() []K
+	// Reset forgets every key.
+	Reset()
+}
+
+type Evictor = KeyedEvictor[string]
+
+// KeyedFIFOEvictor evicts keys in the order they were added.
+type KeyedFIFOEvictor[K comparable] struct {
+	b *KeyedStampBuffer[K]
+}
+
+type FIFOEvictor = KeyedFIFOEvictor[string]
+
+func NewKeyedFIFOEvictor[K comparable](size int64) *KeyedFIFOEvictor[K] {
+	return &KeyedFIFOEvictor[K]{
+		b: NewKeyedStampBuffer[K](size),
+	}
+}
+
+func NewFIFOEvictor(size int64) *FIFOEvictor {
+	return NewKeyedFIFOEvictor[string](size)
+}
+
+func (e *KeyedFIFOEvictor[K]) Add(key K) []K {
+	if popped, err := e.b.PopIfFullThenPush(key); err == nil {
+		return []K{popped}
+	}
+	return nil
+}
+
+func (e *KeyedFIFOEvictor[K]) Touch(key K) {}
+
+func (e *KeyedFIFOEvictor[K]) Keys() []K {
+	return e.b.Values()
+}
+
+func (e *KeyedFIFOEvictor[K]) Reset() {
+	e.b.Reset()
+}
+
+// KeyedLRUEvictor evicts the key that was ticked least recently. A size of
+// zero or less never evicts.
+type KeyedLRUEvictor[K comparable] struct {
+	size  int
+	order *list.List
+	items map[K]*list.Element
+}
+
+type LRUEvictor = KeyedLRUEvictor[string]
+
+func NewKeyedLRUEvictor[K comparable](size int) *KeyedLRUEvictor[K] {
+	return &KeyedLRUEvictor[K]{
+		size:  size,
+		order: list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+func NewLRUEvictor(size int) *LRUEvictor {
+	return NewKeyedLRUEvictor[string](size)
+}
+
+func (e *KeyedLRUEvictor[K]) Add(key K) []K {
+	var evicted []K
+	for e.size > 0 && e.order.Len() >= e.size {
+		oldest := e.order.Back()
+		evicted = append(evicted, e.remove(oldest))
+	}
+	e.items[key] = e.order.PushFront(key)
+	return evicted
+}
+
+func (e *KeyedLRUEvictor[K]) Touch(key K) {
+	if el, ok := e.items[key]; ok {
+		e.order.MoveToFront(el)
+	}
+}
+
+func (e *KeyedLRUEvictor[K]) Keys() []K {
+	keys := make([]K, 0, e.order.Len())
+	for el := e.order.Back(); el != nil; el = el.Prev() {
+		keys = append(keys, el.Value.(K))
+	}
+	return keys
+}
+
+func (e *KeyedLRUEvictor[K]) Reset() {
+	e.order.Init()
+	e.items = make(map[K]*list.Element)
+}
+
+func (e *KeyedLRUEvictor[K]) remove(el *list.Element) K {
+	key := e.order.Remove(el).(K)
+	delete(e.items, key)
+	return key
+}
+
+// KeyedLFUEvictor evicts the key that was ticked least often. Ties are
+// broken by evicting the key that was ticked least recently. A size of
+// zero or less never evicts.
+type KeyedLFUEvictor[K comparable] struct {
+	size  int
+	seq   uint64
+	heap  lfuHeap[K]
+	items map[K]*lfuItem[K]
+}
+
+type LFUEvictor = KeyedLFUEvictor[string]
+
+type lfuItem[K comparable] struct {
+	key   K
+	freq  uint64
+	seq   uint64
+	index int
+}
+
+type lfuHeap[K comparable] []*lfuItem[K]
+
+func (h lfuHeap[K]) Len() int { return len(h) }
+
+func (h lfuHeap[K]) Less(i, j int) bool {
+	if h[i].freq == h[j].freq {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].freq < h[j].freq
+}
+
+func (h lfuHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap[K]) Push(x interface{}) {
+	item := x.(*lfuItem[K])
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap[K]) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+func NewKeyedLFUEvictor[K comparable](size int) *KeyedLFUEvictor[K] {
+	return &KeyedLFUEvictor[K]{
+		size:  size,
+		items: make(map[K]*lfuItem[K]),
+	}
+}
+
+func NewLFUEvictor(size int) *LFUEvictor {
+	return NewKeyedLFUEvictor[string](size)
+}
+
+func (e *KeyedLFUEvictor[K]) Add(key K) []K {
+	var evicted []K
+	for e.size > 0 && e.heap.Len() >= e.size {
+		item := heap.Pop(&e.heap).(*lfuItem[K])
+		delete(e.items, item.key)
+		evicted = append(evicted, item.key)
+	}
+	e.seq++
+	item := &lfuItem[K]{key: key, freq: 1, seq: e.seq}
+	heap.Push(&e.heap, item)
+	e.items[key] = item
+	return evicted
+}
+
+func (e *KeyedLFUEvictor[K]) Touch(key K) {
+	if item, ok := e.items[key]; ok {
+		e.seq++
+		item.freq++
+		item.seq = e.seq
+		heap.Fix(&e.heap, item.index)
+	}
+}
+
+func (e *KeyedLFUEvictor[K]) Keys() []K {
+	items := make(lfuHeap[K], len(e.heap))
+	copy(items, e.heap)
+	sort.Slice(items, func(i, j int) bool {
+		return items.Less(i, j)
+	})
+
+	keys := make([]K, len(items))
+	for i, item := range items {
+		keys[i] = item.key
+	}
+	return keys
+}
+
+func (e *KeyedLFUEvictor[K]) Reset() {
+	e.seq = 0
+	e.heap = nil
+	e.items = make(map[K]*lfuItem[K])
+}
+
+// KeyedTTLEvictor evicts keys that have not been ticked for longer than
+// ttl. Expired keys are collected whenever a new key is added. If size is
+// greater than zero the least recently ticked key is also evicted once
+// size keys are held.
+type KeyedTTLEvictor[K comparable] struct {
+	ttl   time.Duration
+	size  int
+	now   func() time.Time
+	order *list.List
+	items map[K]*list.Element
+}
+
+type TTLEvictor = KeyedTTLEvictor[string]
+
+type ttlEntry[K comparable] struct {
+	key     K
+	touched time.Time
+}
+
+func NewKeyedTTLEvictor[K comparable](ttl time.Duration, size int) *KeyedTTLEvictor[K] {
+	return &KeyedTTLEvictor[K]{
+		ttl:   ttl,
+		size:  size,
+		now:   time.Now,
+		order: list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+func NewTTLEvictor(ttl time.Duration, size int) *TTLEvictor {
+	return NewKeyedTTLEvictor[string](ttl, size)
+}
+
+func (e *KeyedTTLEvictor[K]) Add(key K) []K {
+	now := e.now()
+
+	var evicted []K
+	for oldest := e.order.Back(); oldest != nil; oldest = e.order.Back() {
+		entry := oldest.Value.(*ttlEntry[K])
+		expired := now.Sub(entry.touched) > e.ttl
+		full := e.size > 0 && e.order.Len() >= e.size
+		if !expired && !full {
+			break
+		}
+		e.order.Remove(oldest)
+		delete(e.items, entry.key)
+		evicted = append(evicted, entry.key)
+	}
+
+	e.items[key] = e.order.PushFront(&ttlEntry[K]{key: key, touched: now})
+	return evicted
+}
+
+func (e *KeyedTTLEvictor[K]) Touch(key K) {
+	if el, ok := e.items[key]; ok {
+		el.Value.(*ttlEntry[K]).touched = e.now()
+		e.order.MoveToFront(el)
+	}
+}
+
+func (e *KeyedTTLEvictor[K]) Keys() []K {
+	keys := make([]K, 0, e.order.Len())
+	for el := e.order.Back(); el != nil; el = el.Prev() {
+		keys = append(keys, el.Value.(*ttlEntry[K]).key)
+	}
+	return keys
+}
+
+func (e *KeyedTTLEvictor[K]) Reset() {
+	e.order.Init()
+	e.items = make(map[K]*list.Element)
+}
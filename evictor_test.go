@@ -0,0 +1,117 @@
+package lampstamp
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFIFOEvictor(t *testing.T) {
+	e := NewFIFOEvictor(3)
+	assert.Empty(t, e.Add("a"))
+	assert.Empty(t, e.Add("b"))
+	e.Touch("a")
+	assert.Equal(t, []string{"a"}, e.Add("c"))
+	assert.Equal(t, []string{"b"}, e.Add("d"))
+}
+
+func TestLRUEvictor(t *testing.T) {
+	e := NewLRUEvictor(2)
+	assert.Empty(t, e.Add("a"))
+	assert.Empty(t, e.Add("b"))
+	e.Touch("a")
+	assert.Equal(t, []string{"b"}, e.Add("c"))
+	assert.Equal(t, []string{"a"}, e.Add("d"))
+}
+
+func TestLFUEvictor(t *testing.T) {
+	e := NewLFUEvictor(2)
+	assert.Empty(t, e.Add("a"))
+	assert.Empty(t, e.Add("b"))
+	e.Touch("a")
+	e.Touch("a")
+	e.Touch("b")
+	assert.Equal(t, []string{"b"}, e.Add("c"))
+	// "c" has been ticked once, "a" three times
+	assert.Equal(t, []string{"c"}, e.Add("d"))
+	e.Touch("d")
+	e.Touch("d")
+	// "a" and "d" are both at 3, "a" was ticked longer ago
+	assert.Equal(t, []string{"a"}, e.Add("e"))
+}
+
+func TestTTLEvictor(t *testing.T) {
+	now := time.Unix(0, 0)
+	e := NewTTLEvictor(time.Minute, 0)
+	e.now = func() time.Time { return now }
+
+	assert.Empty(t, e.Add("a"))
+	now = now.Add(30 * time.Second)
+	assert.Empty(t, e.Add("b"))
+	now = now.Add(20 * time.Second)
+	e.Touch("a")
+	now = now.Add(50 * time.Second)
+	assert.Equal(t, []string{"b"}, e.Add("c"))
+	now = now.Add(2 * time.Minute)
+	assert.ElementsMatch(t, []string{"a", "c"}, e.Add("d"))
+}
+
+func TestTTLEvictorSize(t *testing.T) {
+	e := NewTTLEvictor(time.Hour, 2)
+	assert.Empty(t, e.Add("a"))
+	assert.Empty(t, e.Add("b"))
+	e.Touch("a")
+	assert.Equal(t, []string{"b"}, e.Add("c"))
+}
+
+func TestLampstampEvictors(t *testing.T) {
+	evictors := map[string]Evictor{
+		"fifo": NewFIFOEvictor(4),
+		"lru":  NewLRUEvictor(3),
+		"lfu":  NewLFUEvictor(3),
+		"ttl":  NewTTLEvictor(time.Hour, 3),
+	}
+	for name, e := range evictors {
+		t.Run(name, func(t *testing.T) {
+			lt := NewLampstamp(WithEvictor(e))
+			last := make(map[string]int64)
+			for i := 0; i < 50; i++ {
+				key := strconv.Itoa(i % 7)
+				val := lt.Tick(key, 0)
+				assert.Greater(t, val, last[key])
+				last[key] = val
+			}
+			assert.LessOrEqual(t, len(lt.m), 3)
+		})
+	}
+}
+
+func TestLampstampLRUKeepsHotKey(t *testing.T) {
+	lt := NewLampstamp(WithEvictor(NewLRUEvictor(2)))
+	for i := 0; i < 10; i++ {
+		lt.Inc("hot")
+		lt.Inc(strconv.Itoa(i))
+	}
+	assert.EqualValues(t, 10, lt.m["hot"])
+}
+
+func TestKeyedEvictors(t *testing.T) {
+	evictors := map[string]KeyedEvictor[int]{
+		"fifo": NewKeyedFIFOEvictor[int](3),
+		"lru":  NewKeyedLRUEvictor[int](2),
+		"lfu":  NewKeyedLFUEvictor[int](2),
+		"ttl":  NewKeyedTTLEvictor[int](time.Hour, 2),
+	}
+	for name, e := range evictors {
+		t.Run(name, func(t *testing.T) {
+			assert.Empty(t, e.Add(1))
+			assert.Empty(t, e.Add(2))
+			assert.Equal(t, []int{1}, e.Add(3))
+			assert.Equal(t, []int{2, 3}, e.Keys())
+			e.Reset()
+			assert.Empty(t, e.Keys())
+		})
+	}
+}
@@ -142,18 +142,15 @@ func (s *Server) Receive() {
 
 	time.Sleep(s.delay)
 
-	// validate before ticking
-	var version int64
-	if version = s.Timestamp.Get(msg.ID); msg.Version < version {
+	// validate and tick atomically
+	version, err := s.Timestamp.ValidateAndTick(msg.ID, msg.Version)
+	if err != nil {
 		msg.Failed = true
 		log.Printf("\tERROR %s server version is higher than msg version, '%s'\n", s.ID, msg.String())
-		// log.Printf("\t%s fail %s(%s), msg.Version < version %d < %d\n", s.ID, msg.ID, msg.Text, msg.Version, version)
 		clientChannel, _ := s.clientChannels.Load(msg.ClientID)
 		clientChannel.(chan Message) <- msg
 		return
 	}
-
-	version = s.Timestamp.Tick(msg.ID, msg.Version)
 	msg.Version = version
 
 	s.storage.Begin()
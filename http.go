@@ -0,0 +1,84 @@
+package lampstamp
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	DefaultKeyHeader       = "Lampstamp-Key"
+	DefaultTimestampHeader = "Lampstamp-Timestamp"
+)
+
+// Middleware does for HTTP handlers what the example Server.Receive does:
+// it reads the key and timestamp of a request, rejects stale timestamps
+// with 409 Conflict and the current timestamp, and otherwise ticks the
+// clock and hands the new timestamp to the handler through the request
+// context and the response header.
+//
+// Requests without a key are passed through untouched. A missing
+// timestamp counts as zero, so it is stale once the key has been ticked.
+type Middleware struct {
+	Clock Clock
+
+	// KeyHeader and TimestampHeader default to DefaultKeyHeader and
+	// DefaultTimestampHeader.
+	KeyHeader       string
+	TimestampHeader string
+
+	// Key, if set, derives the key from the request instead of KeyHeader,
+	// for instance from the path.
+	Key func(r *http.Request) string
+}
+
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := m.key(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var requestTimestamp int64
+		if h := r.Header.Get(m.timestampHeader()); h != "" {
+			var err error
+			if requestTimestamp, err = strconv.ParseInt(h, 10, 64); err != nil {
+				http.Error(w, "invalid timestamp", http.StatusBadRequest)
+				return
+			}
+		}
+
+		ts, err := m.Clock.ValidateAndTickCtx(r.Context(), key, requestTimestamp)
+		var stale *StaleError
+		if errors.As(err, &stale) {
+			w.Header().Set(m.timestampHeader(), strconv.FormatInt(stale.Current, 10))
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set(m.timestampHeader(), strconv.FormatInt(ts, 10))
+		next.ServeHTTP(w, r.WithContext(ContextWithTimestamp(r.Context(), key, ts)))
+	})
+}
+
+func (m *Middleware) key(r *http.Request) string {
+	if m.Key != nil {
+		return m.Key(r)
+	}
+	if m.KeyHeader != "" {
+		return r.Header.Get(m.KeyHeader)
+	}
+	return r.Header.Get(DefaultKeyHeader)
+}
+
+func (m *Middleware) timestampHeader() string {
+	if m.TimestampHeader != "" {
+		return m.TimestampHeader
+	}
+	return DefaultTimestampHeader
+}
@@ -0,0 +1,95 @@
+package lampstamp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRequest(key, ts string) *http.Request {
+	r := httptest.NewRequest(http.MethodPut, "/messages/"+key, nil)
+	if key != "" {
+		r.Header.Set(DefaultKeyHeader, key)
+	}
+	if ts != "" {
+		r.Header.Set(DefaultTimestampHeader, ts)
+	}
+	return r
+}
+
+func TestMiddleware(t *testing.T) {
+	lt := NewLampstamp()
+	m := &Middleware{Clock: lt}
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts, ok := TimestampFromContext(r.Context())
+		assert.True(t, ok)
+		fmt.Fprint(w, ts)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest("msg-id-1", "1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get(DefaultTimestampHeader))
+	assert.Equal(t, "2", w.Body.String())
+
+	// a request that has not seen version 2 is stale
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest("msg-id-1", "1"))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "2", w.Header().Get(DefaultTimestampHeader))
+	assert.EqualValues(t, 2, lt.Get("msg-id-1"))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest("msg-id-1", ""))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest("msg-id-1", "x"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestMiddlewarePassesThroughWithoutKey(t *testing.T) {
+	m := &Middleware{Clock: NewLampstamp()}
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := TimestampFromContext(r.Context())
+		assert.False(t, ok)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest("", "1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(DefaultTimestampHeader))
+}
+
+func TestMiddlewareCustomKey(t *testing.T) {
+	m := &Middleware{
+		Clock:           NewLampstamp(),
+		TimestampHeader: "X-Version",
+		Key: func(r *http.Request) string {
+			return strings.TrimPrefix(r.URL.Path, "/messages/")
+		},
+	}
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest(http.MethodPut, "/messages/msg-id-1", nil)
+	r.Header.Set("X-Version", "41")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "42", w.Header().Get("X-Version"))
+}
+
+func TestMiddlewareClockError(t *testing.T) {
+	m := &Middleware{Clock: NewLampstamp()}
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest("msg-id-1", "1").WithContext(ctx))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
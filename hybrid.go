@@ -0,0 +1,166 @@
+package lampstamp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Hybrid timestamps pack milliseconds since the Unix epoch into the upper
+// 48 bits and a logical counter into the lower 16. They compare like
+// Lamport timestamps and read like wall time.
+const hybridLogicalBits = 16
+
+func HybridTimestamp(physical time.Time, logical int64) int64 {
+	return physical.UnixNano()/int64(time.Millisecond)<<hybridLogicalBits | logical&(1<<hybridLogicalBits-1)
+}
+
+// HybridPhysical returns the wall time part of a hybrid timestamp.
+func HybridPhysical(ts int64) time.Time {
+	ms := ts >> hybridLogicalBits
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+}
+
+// HybridLogical returns the logical counter of a hybrid timestamp.
+func HybridLogical(ts int64) int64 {
+	return ts & (1<<hybridLogicalBits - 1)
+}
+
+var ErrClockSkew = errors.New("remote timestamp too far in the future")
+
+// HybridClock is a per-key hybrid logical clock. It has the semantics of
+// Lampstamp, except that timestamps never fall behind the physical time of
+// the node. A non-zero maxSkew rejects remote timestamps that are ahead of
+// the physical time by more than that, so one node with a broken clock
+// cannot drag every other node into the future.
+type HybridClock struct {
+	m map[string]int64
+	l sync.RWMutex
+	e Evictor
+
+	floor   int64
+	now     func() time.Time
+	maxSkew time.Duration
+}
+
+var _ Clock = (*HybridClock)(nil)
+
+func NewHybridClock(maxSkew time.Duration, opts ...Option) *HybridClock {
+	o := newOptions(opts)
+
+	return &HybridClock{
+		m:       make(map[string]int64),
+		e:       o.evictor,
+		floor:   defaultTimestamp,
+		now:     o.now,
+		maxSkew: maxSkew,
+	}
+}
+
+func (hc *HybridClock) Get(key string) int64 {
+	hc.l.RLock()
+	defer hc.l.RUnlock()
+
+	if val, ok := hc.m[key]; ok {
+		return val
+	}
+	return hc.floor
+}
+
+func (hc *HybridClock) Inc(key string) int64 {
+	hc.l.Lock()
+	defer hc.l.Unlock()
+
+	val, ok := hc.get(key)
+	return hc.set(key, max(val+1, HybridTimestamp(hc.now(), 0)), ok)
+}
+
+func (hc *HybridClock) Tick(key string, requestTimestamp int64) (int64, error) {
+	hc.l.Lock()
+	defer hc.l.Unlock()
+
+	now := hc.now()
+	if err := hc.checkSkew(now, requestTimestamp); err != nil {
+		return defaultTimestamp, err
+	}
+
+	val, ok := hc.get(key)
+	return hc.set(key, max(max(val, requestTimestamp)+1, HybridTimestamp(now, 0)), ok), nil
+}
+
+func (hc *HybridClock) ValidateAndTick(key string, requestTimestamp int64) (int64, error) {
+	hc.l.Lock()
+	defer hc.l.Unlock()
+
+	now := hc.now()
+	if err := hc.checkSkew(now, requestTimestamp); err != nil {
+		return defaultTimestamp, err
+	}
+
+	val, ok := hc.get(key)
+	if requestTimestamp < val {
+		return val, &StaleError{Key: key, Request: requestTimestamp, Current: val}
+	}
+	return hc.set(key, max(requestTimestamp+1, HybridTimestamp(now, 0)), ok), nil
+}
+
+func (hc *HybridClock) GetCtx(ctx context.Context, key string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return hc.Get(key), nil
+}
+
+func (hc *HybridClock) IncCtx(ctx context.Context, key string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return hc.Inc(key), nil
+}
+
+func (hc *HybridClock) TickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return hc.Tick(key, requestTimestamp)
+}
+
+func (hc *HybridClock) ValidateAndTickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return hc.ValidateAndTick(key, requestTimestamp)
+}
+
+func (hc *HybridClock) checkSkew(now time.Time, requestTimestamp int64) error {
+	if hc.maxSkew <= 0 {
+		return nil
+	}
+	if skew := HybridPhysical(requestTimestamp).Sub(now); skew > hc.maxSkew {
+		return fmt.Errorf("%w: %s ahead, at most %s allowed", ErrClockSkew, skew, hc.maxSkew)
+	}
+	return nil
+}
+
+func (hc *HybridClock) get(key string) (int64, bool) {
+	if val, ok := hc.m[key]; ok {
+		return val, true
+	}
+	return hc.floor, false
+}
+
+func (hc *HybridClock) set(key string, val int64, known bool) int64 {
+	hc.m[key] = val
+	if known {
+		hc.e.Touch(key)
+		return val
+	}
+
+	for _, evicted := range hc.e.Add(key) {
+		hc.floor = max(hc.floor, hc.m[evicted])
+		delete(hc.m, evicted)
+	}
+	return val
+}
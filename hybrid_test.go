@@ -0,0 +1,93 @@
+package lampstamp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHybridTimestamp(t *testing.T) {
+	now := time.Date(2022, 10, 1, 11, 32, 53, 123456789, time.UTC)
+	ts := HybridTimestamp(now, 7)
+	assert.True(t, now.Truncate(time.Millisecond).Equal(HybridPhysical(ts)))
+	assert.EqualValues(t, 7, HybridLogical(ts))
+	assert.Less(t, ts, HybridTimestamp(now, 8))
+	assert.Less(t, HybridTimestamp(now, 1<<hybridLogicalBits-1), HybridTimestamp(now.Add(time.Millisecond), 0))
+}
+
+func TestHybridClock(t *testing.T) {
+	now := time.Date(2022, 10, 1, 11, 32, 53, 0, time.UTC)
+	hc := NewHybridClock(0, WithNow(func() time.Time { return now }))
+
+	assert.EqualValues(t, 0, hc.Get("a"))
+
+	// physical time moves ahead of the counter
+	ts := hc.Inc("a")
+	assert.Equal(t, HybridTimestamp(now, 0), ts)
+
+	// same millisecond, logical part counts
+	ts = hc.Inc("a")
+	assert.Equal(t, HybridTimestamp(now, 1), ts)
+
+	// a remote timestamp ahead of us is followed
+	remote := HybridTimestamp(now.Add(time.Second), 5)
+	ts, err := hc.Tick("a", remote)
+	assert.NoError(t, err)
+	assert.Equal(t, HybridTimestamp(now.Add(time.Second), 6), ts)
+
+	// time catches up and overtakes the logical counter
+	now = now.Add(2 * time.Second)
+	ts, err = hc.Tick("a", remote)
+	assert.NoError(t, err)
+	assert.Equal(t, HybridTimestamp(now, 0), ts)
+	assert.Equal(t, ts, hc.Get("a"))
+}
+
+func TestHybridClockGoesForwardWhenTimeGoesBack(t *testing.T) {
+	now := time.Date(2022, 10, 1, 11, 32, 53, 0, time.UTC)
+	hc := NewHybridClock(0, WithNow(func() time.Time { return now }))
+
+	prev := hc.Inc("a")
+	now = now.Add(-time.Minute)
+	ts := hc.Inc("a")
+	assert.Greater(t, ts, prev)
+}
+
+func TestHybridClockMaxSkew(t *testing.T) {
+	now := time.Date(2022, 10, 1, 11, 32, 53, 0, time.UTC)
+	hc := NewHybridClock(time.Second, WithNow(func() time.Time { return now }))
+
+	_, err := hc.Tick("a", HybridTimestamp(now.Add(500*time.Millisecond), 0))
+	assert.NoError(t, err)
+
+	prev := hc.Get("a")
+	_, err = hc.Tick("a", HybridTimestamp(now.Add(time.Minute), 0))
+	assert.ErrorIs(t, err, ErrClockSkew)
+	_, err = hc.ValidateAndTick("a", HybridTimestamp(now.Add(time.Minute), 0))
+	assert.ErrorIs(t, err, ErrClockSkew)
+	assert.Equal(t, prev, hc.Get("a"))
+}
+
+func TestHybridClockValidateAndTick(t *testing.T) {
+	now := time.Date(2022, 10, 1, 11, 32, 53, 0, time.UTC)
+	hc := NewHybridClock(0, WithNow(func() time.Time { return now }))
+
+	ts := hc.Inc("a")
+	_, err := hc.ValidateAndTick("a", ts-1)
+	assert.ErrorIs(t, err, ErrStale)
+
+	next, err := hc.ValidateAndTick("a", ts)
+	assert.NoError(t, err)
+	assert.Equal(t, ts+1, next)
+}
+
+func TestHybridClockEviction(t *testing.T) {
+	now := time.Date(2022, 10, 1, 11, 32, 53, 0, time.UTC)
+	hc := NewHybridClock(0, WithEvictor(NewLRUEvictor(1)), WithNow(func() time.Time { return now }))
+
+	a := hc.Inc("a")
+	a = hc.Inc("a")
+	hc.Inc("b")
+	assert.Greater(t, hc.Inc("a"), a)
+}
@@ -1,82 +1,371 @@
 package lampstamp
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
 
-type Lampstamp struct {
-	m map[string]int64
+// KeyedLampstamp keeps a Lamport timestamp per key for a bounded number of
+// keys.
+type KeyedLampstamp[K comparable] struct {
+	m map[K]int64
 	l sync.RWMutex
-	b *StampBuffer
+	e KeyedEvictor[K]
+
+	nodeID string
+	node   *NodeClock
+
+	loader      func(context.Context, K) (int64, error)
+	loadTimeout time.Duration
+	flight      flightGroup[K]
+	// unseeded holds the keys ticked while their load failed, which are
+	// loaded again on their next access.
+	unseeded map[K]struct{}
+
+	// floor is the highest counter ever evicted. Keys that are not in m
+	// start from it so that no key goes backwards after eviction.
+	floor int64
 }
 
-func NewLampstamp() *Lampstamp {
-	return NewLampstampSize(1024)
+type Lampstamp = KeyedLampstamp[string]
+
+type options[K comparable] struct {
+	evictor KeyedEvictor[K]
+	now     func() time.Time
+	nodeID  string
+	node    *NodeClock
+	loader  func(context.Context, K) (int64, error)
 }
 
-func NewLampstampSize(size int64) *Lampstamp {
-	return &Lampstamp{
-		m: make(map[string]int64),
-		b: NewStampBuffer(size),
+// KeyedOption configures a clock with keys of type K, so that an evictor or
+// loader made for another key type does not compile.
+type KeyedOption[K comparable] func(*options[K])
+
+type Option = KeyedOption[string]
+
+// WithEvictor sets the eviction policy. The default is a FIFOEvictor
+// holding 1024 keys.
+func WithEvictor(e Evictor) Option {
+	return WithKeyedEvictor[string](e)
+}
+
+// WithKeyedEvictor is WithEvictor for clocks with keys of type K.
+func WithKeyedEvictor[K comparable](e KeyedEvictor[K]) KeyedOption[K] {
+	return func(o *options[K]) {
+		o.evictor = e
+	}
+}
+
+// WithNodeID sets the node ID that breaks ties between Stamps issued by
+// different nodes.
+func WithNodeID(id string) Option {
+	return WithKeyedNodeID[string](id)
+}
+
+// WithKeyedNodeID is WithNodeID for clocks with keys of type K.
+func WithKeyedNodeID[K comparable](id string) KeyedOption[K] {
+	return func(o *options[K]) {
+		o.nodeID = id
+	}
+}
+
+// WithNodeClock folds every tick of the clock into a NodeClock, so that
+// the timestamps of different keys are ordered as well. Clocks sharing a
+// NodeClock are ordered with each other.
+func WithNodeClock(c *NodeClock) Option {
+	return WithKeyedNodeClock[string](c)
+}
+
+// WithKeyedNodeClock is WithNodeClock for clocks with keys of type K.
+func WithKeyedNodeClock[K comparable](c *NodeClock) KeyedOption[K] {
+	return func(o *options[K]) {
+		o.node = c
+	}
+}
+
+// WithNow sets the time source of clocks that read physical time, such as
+// HybridClock. The default is time.Now.
+func WithNow(now func() time.Time) Option {
+	return func(o *options[string]) {
+		o.now = now
+	}
+}
+
+func newOptions[K comparable](opts []KeyedOption[K]) options[K] {
+	o := options[K]{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.now == nil {
+		o.now = time.Now
+	}
+	if o.evictor == nil {
+		o.evictor = NewKeyedFIFOEvictor[K](1024)
+	}
+	return o
+}
+
+func NewKeyedLampstamp[K comparable](opts ...KeyedOption[K]) *KeyedLampstamp[K] {
+	o := newOptions(opts)
+
+	return &KeyedLampstamp[K]{
+		m:           make(map[K]int64),
+		e:           o.evictor,
+		nodeID:      o.nodeID,
+		node:        o.node,
+		loader:      o.loader,
+		loadTimeout: defaultLoadTimeout,
+		floor:       defaultTimestamp,
 	}
 }
 
+func NewLampstamp(opts ...Option) *Lampstamp {
+	return NewKeyedLampstamp[string](opts...)
+}
+
+func NewLampstampSize(size int64) *Lampstamp {
+	return NewLampstamp(WithEvictor(NewFIFOEvictor(size)))
+}
+
 const defaultTimestamp = 0
 
-func (ts *Lampstamp) Get(key string) int64 {
+func (ts *KeyedLampstamp[K]) Get(key K) int64 {
+	val, _ := ts.get(context.Background(), key)
+	return val
+}
+
+// get returns the counter of key. A key the clock does not hold is loaded
+// but not admitted, so that reads do not evict other keys.
+func (ts *KeyedLampstamp[K]) get(ctx context.Context, key K) (int64, error) {
+	if val, ok := ts.lookupSeeded(key); ok {
+		return val, nil
+	}
+	if ts.loader == nil {
+		return ts.Floor(), nil
+	}
+
+	loaded, err := ts.load(ctx, key)
+	if val, ok := ts.lookup(key); ok {
+		return max(val, loaded), err
+	}
+	return max(ts.Floor(), loaded), err
+}
+
+func (ts *KeyedLampstamp[K]) Floor() int64 {
 	ts.l.RLock()
 	defer ts.l.RUnlock()
 
-	if val, ok := ts.m[key]; ok {
-		return val
-	}
+	return ts.floor
+}
 
-	return defaultTimestamp
+func (ts *KeyedLampstamp[K]) Inc(key K) int64 {
+	ts.seedOrRetry(key)
+	return ts.inc(key)
 }
 
-func (ts *Lampstamp) Inc(key string) int64 {
+func (ts *KeyedLampstamp[K]) inc(key K) int64 {
 	ts.l.Lock()
 	defer ts.l.Unlock()
 
 	var val int64
 	var ok bool
 	if val, ok = ts.m[key]; !ok {
-		val = defaultTimestamp
+		val = ts.floor
 	}
 
-	val++
+	val = ts.next(val)
 	ts.m[key] = val
+	ts.touch(key, ok)
 
-	if !ok {
-		if popped, err := ts.b.PopIfFullThenPush(key); err == nil {
-			delete(ts.m, popped)
-		}
+	return val
+}
+
+func (ts *KeyedLampstamp[K]) Tick(key K, requestTimestamp int64) int64 {
+	ts.seedOrRetry(key)
+	return ts.tick(key, requestTimestamp)
+}
+
+func (ts *KeyedLampstamp[K]) tick(key K, requestTimestamp int64) int64 {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+
+	var val int64
+	var ok bool
+	if val, ok = ts.m[key]; !ok {
+		val = ts.floor
 	}
 
+	val = ts.next(max(val, requestTimestamp))
+	ts.m[key] = val
+	ts.touch(key, ok)
+
 	return val
 }
 
-func (ts *Lampstamp) Tick(key string, requestTimestamp int64) int64 {
+var ErrStale = errors.New("stale timestamp")
+
+// StaleError is returned when a request timestamp is behind the clock. It
+// matches ErrStale with errors.Is.
+type StaleError struct {
+	Key     string
+	Request int64
+	Current int64
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("stale timestamp for %s: %d < %d", e.Key, e.Request, e.Current)
+}
+
+func (e *StaleError) Is(target error) bool {
+	return target == ErrStale
+}
+
+func keyString[K comparable](key K) string {
+	if s, ok := interface{}(key).(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// ValidateAndTick ticks key like Tick, but rejects requestTimestamp with a
+// *StaleError if it is lower than the current counter, in which case the
+// current counter is returned unchanged. The check and the tick happen
+// under a single lock. With a loader, a key that cannot be loaded is
+// rejected with the error of the loader.
+func (ts *KeyedLampstamp[K]) ValidateAndTick(key K, requestTimestamp int64) (int64, error) {
+	if err := ts.seed(context.Background(), key); err != nil {
+		return defaultTimestamp, err
+	}
+	return ts.validateAndTick(key, requestTimestamp)
+}
+
+func (ts *KeyedLampstamp[K]) validateAndTick(key K, requestTimestamp int64) (int64, error) {
 	ts.l.Lock()
 	defer ts.l.Unlock()
 
 	var val int64
 	var ok bool
 	if val, ok = ts.m[key]; !ok {
-		val = defaultTimestamp
+		val = ts.floor
+	}
+
+	if requestTimestamp < val {
+		return val, &StaleError{Key: keyString(key), Request: requestTimestamp, Current: val}
 	}
 
-	val = max(val, requestTimestamp)
-	val++
+	val = ts.next(requestTimestamp)
 	ts.m[key] = val
+	ts.touch(key, ok)
 
-	if !ok {
-		if popped, err := ts.b.PopIfFullThenPush(key); err == nil {
-			delete(ts.m, popped)
-		}
+	return val, nil
+}
+
+// Lease raises key past the n counters above max(counter, min) and returns
+// the new counter, leaving the counters between for the caller to issue.
+// n below 1 is taken as 1, which makes Lease a Tick.
+func (ts *KeyedLampstamp[K]) Lease(key K, min, n int64) int64 {
+	ts.seedOrRetry(key)
+	return ts.lease(key, min, n)
+}
+
+func (ts *KeyedLampstamp[K]) lease(key K, min, n int64) int64 {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+
+	var val int64
+	var ok bool
+	if val, ok = ts.m[key]; !ok {
+		val = ts.floor
 	}
 
+	val = ts.next(max(val, min) + max(n, 1) - 1)
+	ts.m[key] = val
+	ts.touch(key, ok)
+
 	return val
 }
 
+// advance raises key to at least val without ticking it. It is used to
+// rebuild a clock from persisted counters.
+func (ts *KeyedLampstamp[K]) advance(key K, val int64) {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+
+	ts.advanceLocked(key, val)
+}
+
+func (ts *KeyedLampstamp[K]) advanceLocked(key K, val int64) {
+	cur, ok := ts.m[key]
+	if !ok {
+		cur = ts.floor
+	}
+
+	ts.m[key] = max(cur, val)
+	ts.touch(key, ok)
+	if ts.node != nil {
+		ts.node.observe(val)
+	}
+}
+
+// lookup returns the counter of a key the clock holds.
+func (ts *KeyedLampstamp[K]) lookup(key K) (int64, bool) {
+	ts.l.RLock()
+	defer ts.l.RUnlock()
+
+	val, ok := ts.m[key]
+	return val, ok
+}
+
+// lookupSeeded is lookup for keys that need no load.
+func (ts *KeyedLampstamp[K]) lookupSeeded(key K) (int64, bool) {
+	ts.l.RLock()
+	defer ts.l.RUnlock()
+
+	if _, retry := ts.unseeded[key]; retry {
+		return defaultTimestamp, false
+	}
+	val, ok := ts.m[key]
+	return val, ok
+}
+
+// raiseFloor lifts every key the clock does not hold to at least val.
+func (ts *KeyedLampstamp[K]) raiseFloor(val int64) {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+
+	ts.floor = max(ts.floor, val)
+	if ts.node != nil {
+		ts.node.observe(val)
+	}
+}
+
+// next returns the timestamp that follows val, which is val + 1 unless the
+// node clock is ahead of it.
+func (ts *KeyedLampstamp[K]) next(val int64) int64 {
+	if ts.node != nil {
+		return ts.node.Tick(val)
+	}
+	return val + 1
+}
+
+// touch tells the evictor about a tick. New keys are admitted, which may
+// evict others and raise the floor to their counters.
+func (ts *KeyedLampstamp[K]) touch(key K, known bool) {
+	if known {
+		ts.e.Touch(key)
+		return
+	}
+
+	for _, evicted := range ts.e.Add(key) {
+		ts.floor = max(ts.floor, ts.m[evicted])
+		delete(ts.m, evicted)
+		delete(ts.unseeded, evicted)
+	}
+}
+
 func max(x, y int64) int64 {
 	if x < y {
 		return y
@@ -1,7 +1,10 @@
 package lampstamp
 
 import (
+	"context"
+	"errors"
 	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/google/uuid"
@@ -24,11 +27,145 @@ func TestLampstamp(t *testing.T) {
 	lt.Tick("12", 1)
 
 	expectedMap := map[string]int64{
-		"0": 4, "10": 3, "11": 2, "12": 2,
+		"0": 6, "10": 5, "11": 4, "12": 4,
 	}
 	expectedBuffer := []string{"0", "10", "11", "12", "9"}
 	assert.EqualValues(t, expectedMap, lt.m)
-	assert.EqualValues(t, expectedBuffer, lt.b.b)
+	assert.EqualValues(t, expectedBuffer, lt.e.(*FIFOEvictor).b.b)
+}
+
+func TestLampstampMonotonicAcrossEviction(t *testing.T) {
+	lt := NewLampstampSize(3)
+	last := make(map[string]int64)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 10; i++ {
+			key := strconv.Itoa(i)
+			assert.GreaterOrEqual(t, lt.Get(key), last[key])
+
+			var val int64
+			if i%2 == 0 {
+				val = lt.Inc(key)
+			} else {
+				val = lt.Tick(key, 1)
+			}
+			assert.Greater(t, val, last[key])
+			last[key] = val
+		}
+	}
+}
+
+func TestLampstampFloor(t *testing.T) {
+	lt := NewLampstampSize(3)
+	assert.EqualValues(t, 0, lt.Get("a"))
+
+	lt.Tick("a", 10)
+	lt.Inc("b")
+	lt.Inc("c")
+
+	// "a" has been evicted, its counter survives as the floor
+	assert.EqualValues(t, 11, lt.Floor())
+	assert.EqualValues(t, 11, lt.Get("a"))
+	assert.EqualValues(t, 11, lt.Get("unknown"))
+	assert.EqualValues(t, 12, lt.Inc("a"))
+}
+
+func TestLampstampValidateAndTick(t *testing.T) {
+	lt := NewLampstamp()
+
+	val, err := lt.ValidateAndTick("a", 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, val)
+
+	val, err = lt.ValidateAndTick("a", 1)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, val)
+
+	val, err = lt.ValidateAndTick("a", 1)
+	assert.ErrorIs(t, err, ErrStale)
+	assert.EqualValues(t, 2, val)
+
+	var stale *StaleError
+	assert.True(t, errors.As(err, &stale))
+	assert.Equal(t, &StaleError{Key: "a", Request: 1, Current: 2}, stale)
+	assert.EqualValues(t, 2, lt.Get("a"))
+}
+
+func TestLampstampLease(t *testing.T) {
+	lt := NewLampstamp()
+
+	// counters 1 to 10 are leased
+	assert.EqualValues(t, 10, lt.Lease("a", 0, 10))
+	assert.EqualValues(t, 11, lt.Inc("a"))
+
+	// above min, which is ahead of the counter
+	assert.EqualValues(t, 60, lt.Lease("a", 50, 10))
+	assert.EqualValues(t, 61, lt.Lease("a", 0, 0))
+
+	val, err := lt.LeaseCtx(context.Background(), "b", 5, 3)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 8, val)
+}
+
+func TestLampstampValidateAndTickRace(t *testing.T) {
+	lt := NewLampstamp()
+	lt.Tick("a", 4)
+
+	var wg sync.WaitGroup
+	var l sync.Mutex
+	accepted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := lt.ValidateAndTick("a", 5); err == nil {
+				l.Lock()
+				accepted++
+				l.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, accepted)
+	assert.EqualValues(t, 6, lt.Get("a"))
+}
+
+type tenantKey struct {
+	tenant string
+	entity int64
+}
+
+func TestKeyedLampstamp(t *testing.T) {
+	lt := NewKeyedLampstamp[tenantKey](WithKeyedEvictor[tenantKey](NewKeyedLRUEvictor[tenantKey](2)))
+
+	a := tenantKey{"tenant-1", 1}
+	assert.EqualValues(t, 1, lt.Inc(a))
+	assert.EqualValues(t, 6, lt.Tick(a, 5))
+	assert.EqualValues(t, 6, lt.Get(a))
+	assert.EqualValues(t, 0, lt.Get(tenantKey{"tenant-2", 1}))
+
+	lt.Inc(tenantKey{"tenant-2", 1})
+	lt.Inc(tenantKey{"tenant-2", 2})
+	assert.EqualValues(t, 6, lt.Floor())
+	assert.EqualValues(t, 7, lt.Inc(a))
+
+	_, err := lt.ValidateAndTick(a, 1)
+	var stale *StaleError
+	assert.True(t, errors.As(err, &stale))
+	assert.Equal(t, "{tenant-1 1}", stale.Key)
+}
+
+func TestKeyedLampstampOptions(t *testing.T) {
+	node := NewNodeClock()
+	lt := NewKeyedLampstamp[int](
+		WithKeyedEvictor[int](NewKeyedLRUEvictor[int](2)),
+		WithKeyedNodeID[int]("svr-1"),
+		WithKeyedNodeClock[int](node),
+		WithLoader(func(ctx context.Context, key int) (int64, error) { return int64(key), nil }),
+	)
+
+	assert.Equal(t, Stamp{11, "svr-1"}, lt.IncStamp(10))
+	assert.EqualValues(t, 11, node.Now())
 }
 
 func BenchmarkLampstamp(b *testing.B) {
@@ -54,3 +191,17 @@ func BenchmarkLampstampParallel(b *testing.B) {
 	})
 
 }
+
+func BenchmarkKeyedLampstampUUID(b *testing.B) {
+	lt := NewKeyedLampstamp[uuid.UUID](WithKeyedEvictor[uuid.UUID](NewKeyedFIFOEvictor[uuid.UUID](102400)))
+	for i := 0; i < b.N; i++ {
+		lt.Tick(uuid.New(), 2)
+	}
+}
+
+func BenchmarkKeyedLampstampInt(b *testing.B) {
+	lt := NewKeyedLampstamp[int](WithKeyedEvictor[int](NewKeyedFIFOEvictor[int](102400)))
+	for i := 0; i < b.N; i++ {
+		lt.Tick(i, 2)
+	}
+}
@@ -0,0 +1,137 @@
+package lampstamp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// WithLoader makes a clock seed keys it does not hold from a source of
+// truth, such as the version a storage already holds, instead of starting
+// them from the floor. Concurrent misses on a key share a single call.
+//
+// The methods taking a context return the errors of the loader, and so does
+// ValidateAndTick, which would otherwise accept stale requests while the
+// source is down. Get falls back to the floor when the loader fails, and
+// Inc, Tick and Lease tick from it; their key is loaded again on its next
+// access, so that it catches up with the source once that is back. Loads
+// without a deadline are bounded by defaultLoadTimeout.
+func WithLoader[K comparable](loader func(ctx context.Context, key K) (int64, error)) KeyedOption[K] {
+	return func(o *options[K]) {
+		o.loader = loader
+	}
+}
+
+// StoreLoader loads the version a VersionedStore holds for a key, for use
+// with WithLoader.
+func StoreLoader(s VersionedStore) func(ctx context.Context, key string) (int64, error) {
+	return func(ctx context.Context, key string) (int64, error) {
+		_, version, err := s.Load(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			return defaultTimestamp, nil
+		}
+		return version, err
+	}
+}
+
+// defaultLoadTimeout bounds loads whose context has no deadline, so that a
+// slow source does not hang every caller of a key.
+const defaultLoadTimeout = 5 * time.Second
+
+// seed loads key if there is a loader and the clock does not hold the key,
+// or holds it from a failed load.
+func (ts *KeyedLampstamp[K]) seed(ctx context.Context, key K) error {
+	if ts.loader == nil {
+		return nil
+	}
+	if _, ok := ts.lookupSeeded(key); ok {
+		return nil
+	}
+
+	val, err := ts.load(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	ts.l.Lock()
+	defer ts.l.Unlock()
+
+	delete(ts.unseeded, key)
+	ts.advanceLocked(key, val)
+	return nil
+}
+
+// seedOrRetry seeds key for the methods that cannot fail. A key that cannot
+// be loaded is marked for its next access to load it again.
+func (ts *KeyedLampstamp[K]) seedOrRetry(key K) {
+	if err := ts.seed(context.Background(), key); err == nil {
+		return
+	}
+
+	ts.l.Lock()
+	defer ts.l.Unlock()
+
+	if ts.unseeded == nil {
+		ts.unseeded = make(map[K]struct{})
+	}
+	ts.unseeded[key] = struct{}{}
+}
+
+// load calls the loader for key, sharing the call with concurrent loads of
+// the same key.
+func (ts *KeyedLampstamp[K]) load(ctx context.Context, key K) (int64, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ts.loadTimeout)
+		defer cancel()
+	}
+
+	return ts.flight.do(ctx, key, func() (int64, error) {
+		return ts.loader(ctx, key)
+	})
+}
+
+// flightGroup runs one call per key at a time and lets concurrent callers
+// for the same key wait for it. The call runs with the context of the
+// caller that started it; waiters stop waiting when their own context is
+// done.
+type flightGroup[K comparable] struct {
+	mu    sync.Mutex
+	calls map[K]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  int64
+	err  error
+}
+
+func (g *flightGroup[K]) do(ctx context.Context, key K, fn func() (int64, error)) (int64, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[K]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.val, c.err
+		case <-ctx.Done():
+			return defaultTimestamp, ctx.Err()
+		}
+	}
+
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	close(c.done)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return c.val, c.err
+}
@@ -0,0 +1,205 @@
+package lampstamp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLampstampLoader(t *testing.T) {
+	versions := map[string]int64{"msg-id-1": 57}
+	lt := NewLampstamp(WithLoader(func(ctx context.Context, key string) (int64, error) {
+		return versions[key], nil
+	}))
+
+	assert.EqualValues(t, 57, lt.Get("msg-id-1"))
+	assert.EqualValues(t, 58, lt.Tick("msg-id-1", 1))
+	assert.EqualValues(t, 1, lt.Inc("msg-id-2"))
+
+	_, err := lt.ValidateAndTickCtx(context.Background(), "msg-id-3", 0)
+	assert.NoError(t, err)
+}
+
+func TestLampstampLoaderAfterEviction(t *testing.T) {
+	var calls int32
+	lt := NewLampstamp(
+		WithEvictor(NewLRUEvictor(1)),
+		WithLoader(func(ctx context.Context, key string) (int64, error) {
+			atomic.AddInt32(&calls, 1)
+			return 10, nil
+		}),
+	)
+
+	assert.EqualValues(t, 11, lt.Inc("a"))
+	assert.EqualValues(t, 12, lt.Inc("a"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	lt.Inc("b")
+	// "a" was evicted and is loaded again, the floor keeps it from going
+	// back to what the loader says
+	assert.EqualValues(t, 13, lt.Inc("a"))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+}
+
+func TestLampstampLoaderError(t *testing.T) {
+	errLoad := errors.New("storage is down")
+	lt := NewLampstamp(WithLoader(func(ctx context.Context, key string) (int64, error) {
+		return 0, errLoad
+	}))
+	ctx := context.Background()
+
+	_, err := lt.GetCtx(ctx, "a")
+	assert.ErrorIs(t, err, errLoad)
+	_, err = lt.IncCtx(ctx, "a")
+	assert.ErrorIs(t, err, errLoad)
+	_, err = lt.TickCtx(ctx, "a", 1)
+	assert.ErrorIs(t, err, errLoad)
+	_, err = lt.ValidateAndTickCtx(ctx, "a", 1)
+	assert.ErrorIs(t, err, errLoad)
+
+	// without a context the floor is used, except for validation, which
+	// would otherwise accept stale requests
+	assert.EqualValues(t, 1, lt.Inc("a"))
+	_, err = lt.ValidateAndTick("b", 0)
+	assert.ErrorIs(t, err, errLoad)
+}
+
+func TestLampstampLoaderRecovery(t *testing.T) {
+	var down int32 = 1
+	lt := NewLampstamp(WithLoader(func(ctx context.Context, key string) (int64, error) {
+		if atomic.LoadInt32(&down) == 1 {
+			return 0, errors.New("storage is down")
+		}
+		return 57, nil
+	}))
+
+	assert.EqualValues(t, 1, lt.Inc("k"))
+	assert.EqualValues(t, 2, lt.Inc("k"))
+
+	// the key catches up with the source once it is back
+	atomic.StoreInt32(&down, 0)
+	val, err := lt.ValidateAndTick("k", 2)
+	var stale *StaleError
+	require.ErrorAs(t, err, &stale)
+	assert.EqualValues(t, 57, stale.Current)
+	assert.EqualValues(t, 57, val)
+	assert.EqualValues(t, 58, lt.Inc("k"))
+	assert.Empty(t, lt.unseeded)
+}
+
+func TestLampstampLoaderTimeout(t *testing.T) {
+	lt := NewLampstamp(WithLoader(func(ctx context.Context, key string) (int64, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}))
+	lt.loadTimeout = 10 * time.Millisecond
+
+	// a hanging source does not hang the methods without a context
+	assert.EqualValues(t, 1, lt.Inc("a"))
+	_, err := lt.ValidateAndTick("b", 0)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLampstampLoaderGetDoesNotAdmit(t *testing.T) {
+	lt := NewLampstamp(
+		WithEvictor(NewFIFOEvictor(1)),
+		WithLoader(func(ctx context.Context, key string) (int64, error) {
+			return 10, nil
+		}),
+	)
+
+	assert.EqualValues(t, 11, lt.Inc("a"))
+	assert.EqualValues(t, 10, lt.Get("b"))
+	val, err := lt.GetCtx(context.Background(), "c")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 10, val)
+
+	// reading other keys did not evict "a"
+	val, ok := lt.lookup("a")
+	assert.True(t, ok)
+	assert.EqualValues(t, 11, val)
+}
+
+func TestLampstampLoaderSingleflight(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	lt := NewLampstamp(WithLoader(func(ctx context.Context, key string) (int64, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 100, nil
+	}))
+
+	const requests = 50
+	var wg sync.WaitGroup
+	results := make(chan int64, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := lt.TickCtx(context.Background(), "msg-id-1", 0)
+			assert.NoError(t, err)
+			results <- val
+		}()
+	}
+
+	assert.Eventually(t, func() bool {
+		lt.flight.mu.Lock()
+		defer lt.flight.mu.Unlock()
+		return len(lt.flight.calls) == 1
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	seen := make(map[int64]bool)
+	for val := range results {
+		assert.Greater(t, val, int64(100))
+		seen[val] = true
+	}
+	assert.Len(t, seen, requests)
+}
+
+func TestLampstampLoaderWaiterCanceled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	lt := NewLampstamp(WithLoader(func(ctx context.Context, key string) (int64, error) {
+		close(started)
+		<-release
+		return 0, nil
+	}))
+
+	go lt.IncCtx(context.Background(), "a")
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := lt.flight.do(ctx, "a", func() (int64, error) { return 0, nil })
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestStoreLoader(t *testing.T) {
+	store := NewMemoryStore()
+	require.NoError(t, store.CompareAndStore(context.Background(), "msg-id-1", []byte("bar"), 57))
+
+	lt := NewLampstamp(WithLoader(StoreLoader(store)))
+	val, err := lt.ValidateAndTickCtx(context.Background(), "msg-id-1", 57)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 58, val)
+
+	// a request that has not seen the stored version is stale even on a
+	// clock that was just started
+	_, err = NewLampstamp(WithLoader(StoreLoader(store))).ValidateAndTickCtx(context.Background(), "msg-id-1", 1)
+	assert.ErrorIs(t, err, ErrStale)
+
+	val, err = lt.IncCtx(context.Background(), "missing")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, val)
+}
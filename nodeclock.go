@@ -0,0 +1,42 @@
+package lampstamp
+
+import "sync/atomic"
+
+// NodeClock is a single Lamport clock for the whole process. It is safe for
+// concurrent use without locks.
+type NodeClock struct {
+	t int64
+}
+
+func NewNodeClock() *NodeClock {
+	return &NodeClock{}
+}
+
+func (c *NodeClock) Now() int64 {
+	return atomic.LoadInt64(&c.t)
+}
+
+func (c *NodeClock) Inc() int64 {
+	return atomic.AddInt64(&c.t, 1)
+}
+
+// Tick moves the clock past remote and returns the new time.
+func (c *NodeClock) Tick(remote int64) int64 {
+	for {
+		cur := atomic.LoadInt64(&c.t)
+		next := max(cur, remote) + 1
+		if atomic.CompareAndSwapInt64(&c.t, cur, next) {
+			return next
+		}
+	}
+}
+
+// observe raises the clock to at least val without ticking it.
+func (c *NodeClock) observe(val int64) {
+	for {
+		cur := atomic.LoadInt64(&c.t)
+		if cur >= val || atomic.CompareAndSwapInt64(&c.t, cur, val) {
+			return
+		}
+	}
+}
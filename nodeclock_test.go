@@ -0,0 +1,82 @@
+package lampstamp
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeClock(t *testing.T) {
+	c := NewNodeClock()
+	assert.EqualValues(t, 0, c.Now())
+	assert.EqualValues(t, 1, c.Inc())
+	assert.EqualValues(t, 11, c.Tick(10))
+	assert.EqualValues(t, 12, c.Tick(3))
+	assert.EqualValues(t, 12, c.Now())
+
+	c.observe(5)
+	assert.EqualValues(t, 12, c.Now())
+	c.observe(20)
+	assert.EqualValues(t, 20, c.Now())
+}
+
+func TestNodeClockConcurrent(t *testing.T) {
+	c := NewNodeClock()
+
+	var wg sync.WaitGroup
+	var l sync.Mutex
+	seen := make(map[int64]bool)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				var val int64
+				if i%2 == 0 {
+					val = c.Inc()
+				} else {
+					val = c.Tick(int64(g))
+				}
+				l.Lock()
+				assert.False(t, seen[val], "%d issued twice", val)
+				seen[val] = true
+				l.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Len(t, seen, 8000)
+}
+
+func TestLampstampWithNodeClock(t *testing.T) {
+	node := NewNodeClock()
+	lt := NewLampstamp(WithNodeClock(node))
+
+	assert.EqualValues(t, 1, lt.Inc("a"))
+	assert.EqualValues(t, 2, lt.Inc("b"))
+	assert.EqualValues(t, 3, lt.Inc("a"))
+	assert.EqualValues(t, 11, lt.Tick("c", 10))
+	assert.EqualValues(t, 12, lt.Tick("a", 0))
+
+	val, err := lt.ValidateAndTick("b", 2)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 13, val)
+	assert.EqualValues(t, 13, node.Now())
+}
+
+func TestLampstampsSharingNodeClock(t *testing.T) {
+	node := NewNodeClock()
+	clocks := []*Lampstamp{
+		NewLampstamp(WithNodeClock(node)),
+		NewLampstamp(WithNodeClock(node)),
+	}
+
+	var last int64
+	for i := 0; i < 100; i++ {
+		val := clocks[i%2].Inc(strconv.Itoa(i % 7))
+		assert.Greater(t, val, last)
+		last = val
+	}
+}
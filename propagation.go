@@ -0,0 +1,176 @@
+package lampstamp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Propagator moves the key and timestamp attached to a context across a
+// transport, in the style of OpenTelemetry propagators.
+type Propagator interface {
+	// Inject writes the key and timestamp of ctx to carrier, if ctx has
+	// any.
+	Inject(ctx context.Context, carrier TextMapCarrier)
+	// Extract returns a copy of ctx holding the key and timestamp read
+	// from carrier, or ctx itself if carrier holds none.
+	Extract(ctx context.Context, carrier TextMapCarrier) context.Context
+}
+
+// TextMapCarrier is a set of string fields a Propagator reads and writes.
+type TextMapCarrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// TextMapPropagator writes the key and the timestamp to two fields, named
+// like the headers of Middleware and Transport by default.
+type TextMapPropagator struct {
+	KeyField       string
+	TimestampField string
+}
+
+var _ Propagator = TextMapPropagator{}
+
+func (p TextMapPropagator) Inject(ctx context.Context, carrier TextMapCarrier) {
+	v, ok := ctx.Value(timestampContextKey{}).(contextTimestamp)
+	if !ok {
+		return
+	}
+	carrier.Set(p.keyField(), v.key)
+	carrier.Set(p.timestampField(), strconv.FormatInt(v.ts, 10))
+}
+
+func (p TextMapPropagator) Extract(ctx context.Context, carrier TextMapCarrier) context.Context {
+	key := carrier.Get(p.keyField())
+	if key == "" {
+		return ctx
+	}
+	ts, err := strconv.ParseInt(carrier.Get(p.timestampField()), 10, 64)
+	if err != nil {
+		return ctx
+	}
+	return ContextWithTimestamp(ctx, key, ts)
+}
+
+func (p TextMapPropagator) keyField() string {
+	if p.KeyField != "" {
+		return p.KeyField
+	}
+	return DefaultKeyHeader
+}
+
+func (p TextMapPropagator) timestampField() string {
+	if p.TimestampField != "" {
+		return p.TimestampField
+	}
+	return DefaultTimestampHeader
+}
+
+// HeaderCarrier adapts http.Header to TextMapCarrier.
+type HeaderCarrier http.Header
+
+func (c HeaderCarrier) Get(key string) string {
+	return http.Header(c).Get(key)
+}
+
+func (c HeaderCarrier) Set(key, value string) {
+	http.Header(c).Set(key, value)
+}
+
+func (c HeaderCarrier) Keys() []string {
+	return sortedKeys(c)
+}
+
+// MapCarrier adapts map[string]string to TextMapCarrier, for message
+// queues and channels that carry string attributes.
+type MapCarrier map[string]string
+
+func (c MapCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c MapCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c MapCarrier) Keys() []string {
+	return sortedKeys(c)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var ErrInvalidBinaryCarrier = errors.New("invalid binary carrier")
+
+// BinaryCarrier is a TextMapCarrier that encodes to a compact binary
+// header for custom framing: a field count followed by length-prefixed
+// names and values, all lengths being uvarints.
+type BinaryCarrier struct {
+	fields map[string]string
+}
+
+func NewBinaryCarrier() *BinaryCarrier {
+	return &BinaryCarrier{
+		fields: make(map[string]string),
+	}
+}
+
+// ParseBinaryCarrier decodes a header written by BinaryCarrier.Bytes.
+func ParseBinaryCarrier(data []byte) (*BinaryCarrier, error) {
+	r := bytes.NewReader(data)
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(len(data)) {
+		return nil, ErrInvalidBinaryCarrier
+	}
+
+	c := NewBinaryCarrier()
+	for i := uint64(0); i < count; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return nil, ErrInvalidBinaryCarrier
+		}
+		value, err := readString(r)
+		if err != nil {
+			return nil, ErrInvalidBinaryCarrier
+		}
+		c.fields[key] = value
+	}
+	if r.Len() != 0 {
+		return nil, ErrInvalidBinaryCarrier
+	}
+	return c, nil
+}
+
+func (c *BinaryCarrier) Get(key string) string {
+	return c.fields[key]
+}
+
+func (c *BinaryCarrier) Set(key, value string) {
+	c.fields[key] = value
+}
+
+func (c *BinaryCarrier) Keys() []string {
+	return sortedKeys(c.fields)
+}
+
+func (c *BinaryCarrier) Bytes() []byte {
+	var buf bytes.Buffer
+	writeUvarint(&buf, uint64(len(c.fields)))
+	for _, key := range c.Keys() {
+		writeString(&buf, key)
+		writeString(&buf, c.fields[key])
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,77 @@
+package lampstamp
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextMapPropagator(t *testing.T) {
+	carriers := map[string]func() TextMapCarrier{
+		"header": func() TextMapCarrier { return HeaderCarrier(http.Header{}) },
+		"map":    func() TextMapCarrier { return MapCarrier{} },
+		"binary": func() TextMapCarrier { return NewBinaryCarrier() },
+	}
+	for name, newCarrier := range carriers {
+		t.Run(name, func(t *testing.T) {
+			p := TextMapPropagator{}
+			ctx := ContextWithTimestamp(context.Background(), "msg-id-1", 42)
+
+			carrier := newCarrier()
+			p.Inject(ctx, carrier)
+			assert.ElementsMatch(t, []string{DefaultKeyHeader, DefaultTimestampHeader}, carrier.Keys())
+
+			extracted := p.Extract(context.Background(), carrier)
+			ts, ok := TimestampFromContext(extracted)
+			assert.True(t, ok)
+			assert.EqualValues(t, 42, ts)
+
+			// nothing to inject or extract
+			empty := newCarrier()
+			p.Inject(context.Background(), empty)
+			assert.Empty(t, empty.Keys())
+			_, ok = TimestampFromContext(p.Extract(context.Background(), empty))
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestTextMapPropagatorFields(t *testing.T) {
+	p := TextMapPropagator{KeyField: "k", TimestampField: "t"}
+	carrier := MapCarrier{}
+	p.Inject(ContextWithTimestamp(context.Background(), "msg-id-1", 7), carrier)
+	assert.Equal(t, MapCarrier{"k": "msg-id-1", "t": "7"}, carrier)
+
+	carrier["t"] = "not a number"
+	_, ok := TimestampFromContext(p.Extract(context.Background(), carrier))
+	assert.False(t, ok)
+}
+
+func TestHeaderCarrierMatchesMiddleware(t *testing.T) {
+	header := http.Header{}
+	TextMapPropagator{}.Inject(ContextWithTimestamp(context.Background(), "msg-id-1", 3), HeaderCarrier(header))
+	assert.Equal(t, "msg-id-1", header.Get(DefaultKeyHeader))
+	assert.Equal(t, "3", header.Get(DefaultTimestampHeader))
+}
+
+func TestBinaryCarrier(t *testing.T) {
+	c := NewBinaryCarrier()
+	TextMapPropagator{KeyField: "k", TimestampField: "t"}.Inject(ContextWithTimestamp(context.Background(), "msg-id-1", 300), c)
+
+	data := c.Bytes()
+	assert.Equal(t, "\x02\x01k\x08msg-id-1\x01t\x03300", string(data))
+
+	parsed, err := ParseBinaryCarrier(data)
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	for i := 0; i < len(data); i++ {
+		_, err := ParseBinaryCarrier(data[:i])
+		assert.ErrorIs(t, err, ErrInvalidBinaryCarrier)
+	}
+	_, err = ParseBinaryCarrier(append(data, 0))
+	assert.ErrorIs(t, err, ErrInvalidBinaryCarrier)
+}
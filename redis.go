@@ -0,0 +1,286 @@
+package lampstamp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RedisOptions struct {
+	// Password and DB are sent with AUTH and SELECT on every new
+	// connection, if set.
+	Password string
+	DB       int
+	// Prefix is prepended to every key, "lampstamp:" by default.
+	Prefix string
+	// TTL, if set, expires keys that have not been ticked for TTL (in
+	// milliseconds) to bound the memory used in Redis. Unknown and expired
+	// keys start from the highest counter ever stored, kept under
+	// Prefix + "floor", so counters never go backwards. The key "floor"
+	// is then reserved and rejected with ErrReservedKey.
+	TTL time.Duration
+}
+
+const (
+	defaultRedisPrefix = "lampstamp:"
+	redisFloorKey      = "floor"
+)
+
+// ErrReservedKey is returned for a key a clock keeps its own state under.
+var ErrReservedKey = errors.New("reserved key")
+
+// ErrTimestampRange is returned for timestamps a clock cannot represent.
+var ErrTimestampRange = errors.New("timestamp out of range")
+
+// redisMaxTimestamp is the highest counter of a RedisClock, as Lua numbers
+// are doubles, which hold integers exactly up to 2^53.
+const redisMaxTimestamp = 1 << 53
+
+// redisTickScript increments, ticks, validates-and-ticks or leases KEYS[1]
+// in a single step. KEYS[2] is the floor of unknown keys, maintained only
+// when keys expire.
+//
+// ARGV: mode ("inc", "tick", "cas" or "lease"), request timestamp, TTL in
+// ms, step. Returns {1, counter}, {0, current} when a "cas" is stale, or
+// {2, current} when the counter would pass redisMaxTimestamp.
+//
+// Counters are stored with %d, as the default formatting switches to
+// exponents.
+const redisTickScript = `
+local ttl = tonumber(ARGV[3])
+local cur = redis.call('GET', KEYS[1])
+if cur then
+  cur = tonumber(cur)
+elseif ttl > 0 then
+  cur = tonumber(redis.call('GET', KEYS[2]) or '0')
+else
+  cur = 0
+end
+local req = tonumber(ARGV[2])
+if ARGV[1] == 'cas' and req < cur then
+  return {0, cur}
+end
+if ARGV[1] ~= 'inc' and req > cur then
+  cur = req
+end
+local step = tonumber(ARGV[4])
+if cur > 9007199254740992 - step then
+  return {2, cur}
+end
+cur = cur + step
+local val = string.format('%d', cur)
+if ttl > 0 then
+  redis.call('SET', KEYS[1], val, 'PX', ttl)
+  local floor = tonumber(redis.call('GET', KEYS[2]) or '0')
+  if cur > floor then
+    redis.call('SET', KEYS[2], val)
+  end
+else
+  redis.call('SET', KEYS[1], val)
+end
+return {1, cur}
+`
+
+var redisTickScriptSHA = func() string {
+	sum := sha1.Sum([]byte(redisTickScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// RedisClock is a Clock keeping its counters in Redis, so that API servers
+// share one clock per key without running lampstampd. Every tick is a
+// single Lua script, which Redis runs atomically. Counters go up to 2^53,
+// and ticks past it fail with ErrTimestampRange.
+type RedisClock struct {
+	pool   connPool
+	prefix string
+	ttl    time.Duration
+}
+
+// DialRedis connects to the Redis server at addr.
+func DialRedis(ctx context.Context, addr string, ro RedisOptions) (*RedisClock, error) {
+	c := &RedisClock{
+		pool:   connPool{addr: addr},
+		prefix: ro.Prefix,
+		ttl:    ro.TTL,
+	}
+	if c.prefix == "" {
+		c.prefix = defaultRedisPrefix
+	}
+	c.pool.init = func(cc *clientConn) error {
+		if ro.Password != "" {
+			if _, err := redisCall(cc, "AUTH", ro.Password); err != nil {
+				return err
+			}
+		}
+		if ro.DB != 0 {
+			if _, err := redisCall(cc, "SELECT", strconv.Itoa(ro.DB)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := c.pool.do(ctx, func(cc *clientConn) error {
+		_, err := redisCall(cc, "PING")
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *RedisClock) GetCtx(ctx context.Context, key string) (int64, error) {
+	if err := c.checkKey(key); err != nil {
+		return defaultTimestamp, err
+	}
+
+	var reply interface{}
+	err := c.pool.do(ctx, func(cc *clientConn) (err error) {
+		reply, err = redisCall(cc, "MGET", c.prefix+key, c.floorKey())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, fmt.Errorf("%w: unexpected MGET reply %v", ErrProtocol, reply)
+	}
+	v := values[0]
+	if v == nil && c.ttl > 0 {
+		v = values[1]
+	}
+	if v == nil {
+		return defaultTimestamp, nil
+	}
+	return redisInt(v)
+}
+
+func (c *RedisClock) IncCtx(ctx context.Context, key string) (int64, error) {
+	return c.tick(ctx, "inc", key, 0, 1)
+}
+
+func (c *RedisClock) TickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	return c.tick(ctx, "tick", key, requestTimestamp, 1)
+}
+
+func (c *RedisClock) ValidateAndTickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	return c.tick(ctx, "cas", key, requestTimestamp, 1)
+}
+
+func (c *RedisClock) LeaseCtx(ctx context.Context, key string, min, n int64) (int64, error) {
+	return c.tick(ctx, "lease", key, min, max(n, 1))
+}
+
+func (c *RedisClock) tick(ctx context.Context, mode, key string, requestTimestamp, step int64) (int64, error) {
+	if err := c.checkKey(key); err != nil {
+		return defaultTimestamp, err
+	}
+	if step > redisMaxTimestamp || requestTimestamp > redisMaxTimestamp-step || requestTimestamp < -redisMaxTimestamp {
+		return defaultTimestamp, fmt.Errorf("%w: %d + %d passes 2^53", ErrTimestampRange, requestTimestamp, step)
+	}
+	args := c.tickArgs(mode, key, requestTimestamp, step)
+
+	var reply interface{}
+	err := c.pool.do(ctx, func(cc *clientConn) (err error) {
+		reply, err = redisCall(cc, append([]string{"EVALSHA", redisTickScriptSHA}, args...)...)
+		// the script cache is empty after a restart or SCRIPT FLUSH
+		var serr *ServerError
+		if errors.As(err, &serr) && strings.HasPrefix(serr.Message, "NOSCRIPT") {
+			reply, err = redisCall(cc, append([]string{"EVAL", redisTickScript}, args...)...)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, fmt.Errorf("%w: unexpected script reply %v", ErrProtocol, reply)
+	}
+	val, err := redisInt(values[1])
+	if err != nil {
+		return 0, err
+	}
+	switch values[0] {
+	case int64(0):
+		return val, &StaleError{Key: key, Request: requestTimestamp, Current: val}
+	case int64(2):
+		return val, fmt.Errorf("%w: %s is at %d", ErrTimestampRange, key, val)
+	}
+	return val, nil
+}
+
+// tickArgs returns the number of keys, the KEYS and the ARGV of a call of
+// redisTickScript.
+func (c *RedisClock) tickArgs(mode, key string, requestTimestamp, step int64) []string {
+	return []string{
+		"2", c.prefix + key, c.floorKey(),
+		mode, strconv.FormatInt(requestTimestamp, 10), strconv.FormatInt(c.ttl.Milliseconds(), 10),
+		strconv.FormatInt(step, 10),
+	}
+}
+
+func (c *RedisClock) floorKey() string {
+	return c.prefix + redisFloorKey
+}
+
+// checkKey rejects the key of the floor when keys expire, as ticking it
+// would give the floor a TTL and restart unknown keys from 0 once it
+// expires.
+func (c *RedisClock) checkKey(key string) error {
+	if c.ttl > 0 && key == redisFloorKey {
+		return fmt.Errorf("%w: %q holds the floor of expired keys", ErrReservedKey, key)
+	}
+	return nil
+}
+
+// Close closes the idle connections.
+func (c *RedisClock) Close() error {
+	return c.pool.Close()
+}
+
+// redisCall sends a command and reads its reply. Error replies are
+// returned as *ServerError.
+func redisCall(cc *clientConn, args ...string) (interface{}, error) {
+	rw := respWriter{w: cc.w}
+	rw.command(args...)
+	if err := cc.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	reply, err := readRESP(cc.r)
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := reply.(respError); ok {
+		return nil, &ServerError{Message: string(rerr)}
+	}
+	return reply, nil
+}
+
+func redisInt(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: invalid counter %q", ErrProtocol, v)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("%w: invalid counter %v", ErrProtocol, v)
+}
+
+var (
+	_ Clock  = (*RedisClock)(nil)
+	_ Leaser = (*RedisClock)(nil)
+)
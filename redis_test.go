@@ -0,0 +1,494 @@
+package lampstamp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is an in-process stand-in for Redis. It speaks RESP2 and runs
+// redisTickScript natively in Go.
+type fakeRedis struct {
+	password string
+
+	mu      sync.Mutex
+	now     time.Time
+	data    map[string]fakeRedisValue
+	scripts map[string]bool
+	calls   map[string]int
+}
+
+type fakeRedisValue struct {
+	val     string
+	expires time.Time
+}
+
+func startFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	f := &fakeRedis{
+		password: password,
+		now:      time.Unix(1700000000, 0),
+		data:     make(map[string]fakeRedisValue),
+		scripts:  make(map[string]bool),
+		calls:    make(map[string]int),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, l.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	rw := &respWriter{w: bufio.NewWriter(conn), proto: 2}
+	authed := f.password == ""
+
+	for {
+		v, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, elem := range v.([]interface{}) {
+			args = append(args, string(elem.([]byte)))
+		}
+
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			if authed {
+				rw.simple("OK")
+			} else {
+				rw.error("WRONGPASS invalid password")
+			}
+		case !authed:
+			rw.error("NOAUTH Authentication required.")
+		default:
+			f.exec(rw, cmd, args[1:])
+		}
+		if err := rw.w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) exec(rw *respWriter, cmd string, args []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls[cmd]++
+	switch cmd {
+	case "PING":
+		rw.simple("PONG")
+	case "SELECT":
+		f.calls["SELECT "+args[0]]++
+		rw.simple("OK")
+	case "MGET":
+		rw.array(len(args))
+		for _, key := range args {
+			if val, ok := f.get(key); ok {
+				rw.bulk(val)
+			} else {
+				rw.w.WriteString("$-1\r\n")
+			}
+		}
+	case "SCRIPT":
+		f.scripts = make(map[string]bool)
+		rw.simple("OK")
+	case "EVALSHA":
+		if !f.scripts[args[0]] {
+			rw.error("NOSCRIPT No matching script. Please use EVAL.")
+			return
+		}
+		f.tick(rw, args[1:])
+	case "EVAL":
+		if args[0] != redisTickScript {
+			rw.error("ERR unknown script")
+			return
+		}
+		f.scripts[redisTickScriptSHA] = true
+		f.tick(rw, args[1:])
+	default:
+		rw.error("ERR unknown command '" + cmd + "'")
+	}
+}
+
+func (f *fakeRedis) get(key string) (string, bool) {
+	v, ok := f.data[key]
+	if !ok || (!v.expires.IsZero() && !f.now.Before(v.expires)) {
+		return "", false
+	}
+	return v.val, true
+}
+
+// tick mirrors redisTickScript on the arguments of EVAL after the script:
+// the number of keys, KEYS and ARGV. Numbers are float64, as in Lua, so
+// that counters lose precision past 2^53 as they do in Redis.
+func (f *fakeRedis) tick(rw *respWriter, args []string) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys < 0 || numKeys > len(args)-1 {
+		rw.error("ERR Number of keys can't be greater than number of args")
+		return
+	}
+	keys, argv := args[1:1+numKeys], args[1+numKeys:]
+	if len(keys) != 2 || len(argv) != 4 {
+		rw.error(fmt.Sprintf("ERR script called with %d keys and %d args", len(keys), len(argv)))
+		return
+	}
+	key, floorKey := keys[0], keys[1]
+	mode := argv[0]
+	req, _ := strconv.ParseFloat(argv[1], 64)
+	ttl, _ := strconv.ParseFloat(argv[2], 64)
+	step, _ := strconv.ParseFloat(argv[3], 64)
+
+	var cur float64
+	if val, ok := f.get(key); ok {
+		cur, _ = strconv.ParseFloat(val, 64)
+	} else if ttl > 0 {
+		val, _ := f.get(floorKey)
+		cur, _ = strconv.ParseFloat(val, 64)
+	}
+
+	if mode == "cas" && req < cur {
+		rw.array(2)
+		rw.int(0)
+		rw.int(int64(cur))
+		return
+	}
+	if mode != "inc" && req > cur {
+		cur = req
+	}
+	if cur > 1<<53-step {
+		rw.array(2)
+		rw.int(2)
+		rw.int(int64(cur))
+		return
+	}
+	cur += step
+
+	val := strconv.FormatFloat(cur, 'f', 0, 64)
+	if ttl > 0 {
+		f.data[key] = fakeRedisValue{val: val, expires: f.now.Add(time.Duration(ttl) * time.Millisecond)}
+		floor, _ := f.get(floorKey)
+		if n, _ := strconv.ParseFloat(floor, 64); cur > n {
+			f.data[floorKey] = fakeRedisValue{val: val}
+		}
+	} else {
+		f.data[key] = fakeRedisValue{val: val}
+	}
+
+	rw.array(2)
+	rw.int(1)
+	rw.int(int64(cur))
+}
+
+func (f *fakeRedis) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+}
+
+func (f *fakeRedis) callCount(cmd string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[cmd]
+}
+
+func dialTestRedis(t *testing.T, addr string, ro RedisOptions) *RedisClock {
+	t.Helper()
+
+	c, err := DialRedis(context.Background(), addr, ro)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestRedisClock(t *testing.T) {
+	f, addr := startFakeRedis(t, "")
+	c := dialTestRedis(t, addr, RedisOptions{})
+	ctx := context.Background()
+
+	ts, err := c.GetCtx(ctx, "msg-id-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), ts)
+
+	ts, err = c.IncCtx(ctx, "msg-id-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), ts)
+
+	ts, err = c.TickCtx(ctx, "msg-id-1", 5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), ts)
+
+	ts, err = c.ValidateAndTickCtx(ctx, "msg-id-1", 3)
+	var stale *StaleError
+	require.ErrorAs(t, err, &stale)
+	assert.Equal(t, StaleError{Key: "msg-id-1", Request: 3, Current: 6}, *stale)
+	assert.Equal(t, int64(6), ts)
+
+	ts, err = c.ValidateAndTickCtx(ctx, "msg-id-1", 6)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), ts)
+
+	ts, err = c.GetCtx(ctx, "msg-id-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), ts)
+
+	ts, err = c.LeaseCtx(ctx, "msg-id-1", 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(17), ts)
+
+	val, ok := f.get("lampstamp:msg-id-1")
+	assert.True(t, ok)
+	assert.Equal(t, "17", val)
+
+	// without a TTL no floor is kept
+	_, ok = f.get("lampstamp:floor")
+	assert.False(t, ok)
+}
+
+func TestRedisClockScriptCache(t *testing.T) {
+	f, addr := startFakeRedis(t, "")
+	c := dialTestRedis(t, addr, RedisOptions{})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := c.IncCtx(ctx, "msg-id-1")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 3, f.callCount("EVALSHA"))
+	assert.Equal(t, 1, f.callCount("EVAL"))
+
+	// a restarted Redis has lost the script
+	f.mu.Lock()
+	f.scripts = make(map[string]bool)
+	f.mu.Unlock()
+	ts, err := c.IncCtx(ctx, "msg-id-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), ts)
+	assert.Equal(t, 2, f.callCount("EVAL"))
+}
+
+func TestRedisClockTTL(t *testing.T) {
+	f, addr := startFakeRedis(t, "")
+	c := dialTestRedis(t, addr, RedisOptions{Prefix: "ts:", TTL: time.Minute})
+	ctx := context.Background()
+
+	ts, err := c.TickCtx(ctx, "msg-id-1", 9)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), ts)
+
+	// unknown keys start from the floor
+	ts, err = c.IncCtx(ctx, "msg-id-2")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), ts)
+
+	// ticking refreshes the TTL
+	f.advance(50 * time.Second)
+	_, err = c.IncCtx(ctx, "msg-id-2")
+	require.NoError(t, err)
+	f.advance(50 * time.Second)
+
+	_, ok := f.get("ts:msg-id-1")
+	assert.False(t, ok)
+	ts, err = c.GetCtx(ctx, "msg-id-2")
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), ts)
+
+	// an expired key does not go back to 0
+	ts, err = c.GetCtx(ctx, "msg-id-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), ts)
+	_, err = c.ValidateAndTickCtx(ctx, "msg-id-1", 10)
+	assert.ErrorIs(t, err, ErrStale)
+	ts, err = c.IncCtx(ctx, "msg-id-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), ts)
+
+	// the floor cannot be ticked as a key
+	_, err = c.TickCtx(ctx, "floor", 1)
+	assert.ErrorIs(t, err, ErrReservedKey)
+	_, err = c.GetCtx(ctx, "floor")
+	assert.ErrorIs(t, err, ErrReservedKey)
+	floor, _ := f.get("ts:floor")
+	assert.Equal(t, "13", floor)
+}
+
+func TestRedisClockAuth(t *testing.T) {
+	f, addr := startFakeRedis(t, "secret")
+
+	_, err := DialRedis(context.Background(), addr, RedisOptions{})
+	var serr *ServerError
+	require.ErrorAs(t, err, &serr)
+	assert.True(t, strings.HasPrefix(serr.Message, "NOAUTH"), serr.Message)
+
+	_, err = DialRedis(context.Background(), addr, RedisOptions{Password: "wrong"})
+	assert.Error(t, err)
+
+	c := dialTestRedis(t, addr, RedisOptions{Password: "secret", DB: 2})
+	ts, err := c.IncCtx(context.Background(), "msg-id-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), ts)
+	assert.Equal(t, 1, f.callCount("SELECT 2"))
+}
+
+func TestRedisClockConcurrent(t *testing.T) {
+	_, addr := startFakeRedis(t, "")
+	c := dialTestRedis(t, addr, RedisOptions{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := c.IncCtx(context.Background(), "msg-id-1")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	ts, err := c.GetCtx(context.Background(), "msg-id-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(400), ts)
+}
+
+func TestRedisClockRange(t *testing.T) {
+	f, addr := startFakeRedis(t, "")
+	c := dialTestRedis(t, addr, RedisOptions{})
+	ctx := context.Background()
+
+	// counters are exact up to 2^53
+	ts, err := c.TickCtx(ctx, "a", redisMaxTimestamp-1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(redisMaxTimestamp), ts)
+	ts, err = c.IncCtx(ctx, "a")
+	assert.ErrorIs(t, err, ErrTimestampRange)
+	assert.Equal(t, int64(redisMaxTimestamp), ts)
+
+	// requests that would pass it are refused before they reach Redis
+	calls := f.callCount("EVALSHA")
+	_, err = c.TickCtx(ctx, "b", redisMaxTimestamp)
+	assert.ErrorIs(t, err, ErrTimestampRange)
+	_, err = c.ValidateAndTickCtx(ctx, "b", redisMaxTimestamp+1)
+	assert.ErrorIs(t, err, ErrTimestampRange)
+	_, err = c.TickCtx(ctx, "b", -redisMaxTimestamp-1)
+	assert.ErrorIs(t, err, ErrTimestampRange)
+	_, err = c.LeaseCtx(ctx, "b", 0, redisMaxTimestamp+1)
+	assert.ErrorIs(t, err, ErrTimestampRange)
+	assert.Equal(t, calls, f.callCount("EVALSHA"))
+
+	// and by the script, to which they are rounded
+	var reply interface{}
+	require.NoError(t, c.pool.do(ctx, func(cc *clientConn) (err error) {
+		args := c.tickArgs("tick", "b", redisMaxTimestamp+1, 1)
+		reply, err = redisCall(cc, append([]string{"EVAL", redisTickScript}, args...)...)
+		return err
+	}))
+	assert.Equal(t, []interface{}{int64(2), int64(redisMaxTimestamp)}, reply)
+
+	// a call whose KEYS and ARGV do not match the script fails
+	err = c.pool.do(ctx, func(cc *clientConn) error {
+		args := c.tickArgs("tick", "b", 1, 1)
+		args[0] = "1"
+		_, err := redisCall(cc, append([]string{"EVAL", redisTickScript}, args...)...)
+		return err
+	})
+	var serr *ServerError
+	assert.ErrorAs(t, err, &serr)
+}
+
+// TestRedisClockRealRedis runs redisTickScript on a real Redis, which the
+// fake only mirrors. It is skipped unless LAMPSTAMP_REDIS_ADDR is set.
+func TestRedisClockRealRedis(t *testing.T) {
+	addr := os.Getenv("LAMPSTAMP_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("set LAMPSTAMP_REDIS_ADDR to run the tick script on a real Redis")
+	}
+
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		prefix := fmt.Sprintf("lampstamp-test:%d:", time.Now().UnixNano())
+		c := dialTestRedis(t, addr, RedisOptions{Prefix: prefix, TTL: ttl})
+		ctx := context.Background()
+		t.Cleanup(func() {
+			c.pool.do(ctx, func(cc *clientConn) error {
+				_, err := redisCall(cc, "DEL", prefix+"a", prefix+"b", prefix+"big", c.floorKey())
+				return err
+			})
+		})
+
+		ts, err := c.IncCtx(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), ts)
+		ts, err = c.TickCtx(ctx, "a", 5)
+		require.NoError(t, err)
+		assert.Equal(t, int64(6), ts)
+
+		ts, err = c.ValidateAndTickCtx(ctx, "a", 3)
+		assert.ErrorIs(t, err, ErrStale)
+		assert.Equal(t, int64(6), ts)
+		ts, err = c.ValidateAndTickCtx(ctx, "a", 6)
+		require.NoError(t, err)
+		assert.Equal(t, int64(7), ts)
+
+		ts, err = c.LeaseCtx(ctx, "a", 20, 10)
+		require.NoError(t, err)
+		assert.Equal(t, int64(30), ts)
+		ts, err = c.GetCtx(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, int64(30), ts)
+
+		// counters are stored without exponents
+		ts, err = c.TickCtx(ctx, "big", 1<<52)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1<<52+1), ts)
+		ts, err = c.GetCtx(ctx, "big")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1<<52+1), ts)
+
+		ts, err = c.IncCtx(ctx, "b")
+		require.NoError(t, err)
+		if ttl > 0 {
+			// unknown keys start from the floor
+			assert.Equal(t, int64(1<<52+2), ts, "ttl %v", ttl)
+		} else {
+			assert.Equal(t, int64(1), ts, "ttl %v", ttl)
+		}
+
+		// up to 2^53, the range of Lua numbers
+		ts, err = c.TickCtx(ctx, "big", redisMaxTimestamp-1)
+		require.NoError(t, err)
+		assert.Equal(t, int64(redisMaxTimestamp), ts)
+		_, err = c.IncCtx(ctx, "big")
+		assert.ErrorIs(t, err, ErrTimestampRange)
+		ts, err = c.GetCtx(ctx, "big")
+		require.NoError(t, err)
+		assert.Equal(t, int64(redisMaxTimestamp), ts)
+	}
+}
@@ -0,0 +1,1285 @@
+package lampstamp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type ReplicatedOptions struct {
+	// ID is the address of this node as listed in Peers.
+	ID string
+	// Peers are the addresses of every node of the group, including ID.
+	// Groups of 3 or 5 nodes survive the loss of 1 or 2.
+	Peers []string
+	// Dir keeps the term, vote, log and snapshots of this node.
+	Dir string
+	// ElectionTimeout is the time after which a follower that has not
+	// heard from a leader stands for election, randomised up to twice
+	// that. 300ms by default.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is the period of empty appends from the leader,
+	// ElectionTimeout/6 by default.
+	HeartbeatInterval time.Duration
+	// SnapshotEntries is the number of applied log entries after which the
+	// log is compacted into a snapshot, 10000 by default.
+	SnapshotEntries int
+	// Dial, if set, connects to other nodes instead of net.Dialer.
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+	// Secret, if set, must be the same on every node. Nodes prove they
+	// know it when they connect, and connections that do not are closed.
+	// Without it, anything that reaches this node from the host of a peer
+	// can rewrite its log.
+	Secret string
+}
+
+const (
+	defaultElectionTimeout = 300 * time.Millisecond
+	defaultSnapshotEntries = 10000
+
+	// raftMaxAppend bounds the entries sent in one append.
+	raftMaxAppend = 512
+	// raftNonceSize is the size of the challenge of a node to a peer
+	// connecting to it, which answers with its HMAC-SHA256 by Secret.
+	raftNonceSize = 32
+
+	raftStateFile    = "raft.state"
+	raftLogFile      = "raft.log"
+	raftSnapshotFile = "raft.snap"
+)
+
+var errNotLeader = errors.New("not the leader")
+
+// ReplicatedClock is a Clock replicated over a group of nodes with the Raft
+// consensus algorithm. Every operation is appended to a log on the leader
+// and applied to a Lampstamp on each node once a majority has stored it,
+// so a timestamp that has been returned survives the loss of any minority
+// of nodes, the leader included. Nodes other than the leader forward
+// operations to it, so clients can use any node.
+//
+// Every node applies the same operations to its Lampstamp, so opts must
+// behave the same on every node: FIFO and LRU evictors do, while TTL
+// evictors, loaders and node clocks do not. A validate-and-tick retried
+// because the leader changed while it was in flight may be rejected as
+// stale by its own first attempt.
+//
+// Nodes drop connections from hosts other than those of the peers, but
+// the protocol between them is not encrypted: keep it on a private network
+// and set a Secret.
+type ReplicatedClock struct {
+	id    string
+	peers []string
+	opts  ReplicatedOptions
+	sm    *Lampstamp
+	l     net.Listener
+	pools map[string]*connPool
+	kick  map[string]chan struct{}
+
+	mu          sync.Mutex
+	applied     *sync.Cond
+	role        raftRole
+	term        uint64
+	votedFor    string
+	leader      string
+	log         []raftEntry
+	snapIndex   uint64
+	snapTerm    uint64
+	snapData    []byte
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	lastContact map[string]time.Time
+	deadline    time.Time
+	waiters     map[uint64]raftWaiter
+	logFile     *os.File
+	conns       map[net.Conn]struct{}
+	closed      bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+type raftOp byte
+
+const (
+	raftNoop raftOp = iota
+	raftGet
+	raftInc
+	raftTick
+	raftValidateAndTick
+	raftLease
+)
+
+type raftEntry struct {
+	Term      uint64
+	Op        raftOp
+	Key       string
+	Timestamp int64
+	N         int64
+}
+
+type raftResult struct {
+	Value     int64
+	Stale     bool
+	Err       string
+	NotLeader bool
+}
+
+type raftWaiter struct {
+	term uint64
+	ch   chan raftResult
+}
+
+// raftRequest carries one of the messages exchanged by nodes, encoded with
+// encoding/gob.
+type raftRequest struct {
+	Vote     *raftVoteRequest
+	Append   *raftAppendRequest
+	Snapshot *raftSnapshotRequest
+	Propose  *raftProposal
+}
+
+type raftVoteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type raftAppendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []raftEntry
+	Commit    uint64
+}
+
+type raftSnapshotRequest struct {
+	Term      uint64
+	Leader    string
+	Index     uint64
+	IndexTerm uint64
+	Data      []byte
+}
+
+type raftProposal struct {
+	Entry   raftEntry
+	Timeout time.Duration
+}
+
+type raftResponse struct {
+	Term    uint64
+	Granted bool
+	Success bool
+	// Hint is the next index to send after a failed append.
+	Hint   uint64
+	Result raftResult
+}
+
+var (
+	_ Clock  = (*ReplicatedClock)(nil)
+	_ Leaser = (*ReplicatedClock)(nil)
+)
+
+// OpenReplicated starts a node of a replicated group, serving the other
+// nodes on l. A node reopened on the same Dir rejoins the group with the
+// state it had.
+func OpenReplicated(l net.Listener, ro ReplicatedOptions, opts ...Option) (*ReplicatedClock, error) {
+	if ro.ElectionTimeout <= 0 {
+		ro.ElectionTimeout = defaultElectionTimeout
+	}
+	if ro.HeartbeatInterval <= 0 {
+		ro.HeartbeatInterval = ro.ElectionTimeout / 6
+	}
+	if ro.SnapshotEntries <= 0 {
+		ro.SnapshotEntries = defaultSnapshotEntries
+	}
+
+	r := &ReplicatedClock{
+		id:          ro.ID,
+		opts:        ro,
+		sm:          NewLampstamp(opts...),
+		l:           l,
+		pools:       make(map[string]*connPool),
+		kick:        make(map[string]chan struct{}),
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		lastContact: make(map[string]time.Time),
+		waiters:     make(map[uint64]raftWaiter),
+		conns:       make(map[net.Conn]struct{}),
+		done:        make(chan struct{}),
+	}
+	r.applied = sync.NewCond(&r.mu)
+
+	found := false
+	for _, peer := range ro.Peers {
+		if peer == ro.ID {
+			found = true
+			continue
+		}
+		r.peers = append(r.peers, peer)
+		r.pools[peer] = &connPool{addr: peer, dial: ro.Dial}
+		if ro.Secret != "" {
+			r.pools[peer].init = r.authenticate
+		}
+		r.kick[peer] = make(chan struct{}, 1)
+	}
+	if !found {
+		return nil, fmt.Errorf("node %q is not one of the peers %q", ro.ID, ro.Peers)
+	}
+
+	if err := os.MkdirAll(ro.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.resetDeadline()
+
+	r.wg.Add(3 + len(r.peers))
+	go r.serve()
+	go r.ticker()
+	go r.applier()
+	for _, peer := range r.peers {
+		go r.replicator(peer)
+	}
+	return r, nil
+}
+
+// Leader returns the ID of the node this node believes to be the leader,
+// or "" during an election.
+func (r *ReplicatedClock) Leader() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.leader
+}
+
+func (r *ReplicatedClock) GetCtx(ctx context.Context, key string) (int64, error) {
+	return r.do(ctx, raftEntry{Op: raftGet, Key: key})
+}
+
+func (r *ReplicatedClock) IncCtx(ctx context.Context, key string) (int64, error) {
+	return r.do(ctx, raftEntry{Op: raftInc, Key: key})
+}
+
+func (r *ReplicatedClock) TickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	return r.do(ctx, raftEntry{Op: raftTick, Key: key, Timestamp: requestTimestamp})
+}
+
+func (r *ReplicatedClock) ValidateAndTickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	return r.do(ctx, raftEntry{Op: raftValidateAndTick, Key: key, Timestamp: requestTimestamp})
+}
+
+func (r *ReplicatedClock) LeaseCtx(ctx context.Context, key string, min, n int64) (int64, error) {
+	return r.do(ctx, raftEntry{Op: raftLease, Key: key, Timestamp: min, N: n})
+}
+
+// do commits e through the leader, retrying across elections until ctx
+// is done.
+func (r *ReplicatedClock) do(ctx context.Context, e raftEntry) (int64, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return defaultTimestamp, err
+		}
+
+		res, err := r.propose(ctx, e)
+		if errors.Is(err, errNotLeader) {
+			if leader := r.Leader(); leader != "" && leader != r.id {
+				res, err = r.forward(ctx, leader, e)
+			}
+		}
+
+		switch {
+		case err == nil && res.NotLeader:
+		case err == nil && res.Stale:
+			return res.Value, &StaleError{Key: e.Key, Request: e.Timestamp, Current: res.Value}
+		case err == nil && res.Err != "":
+			return res.Value, &ServerError{Message: res.Err}
+		case err == nil:
+			return res.Value, nil
+		case errors.Is(err, ErrClosed) || ctx.Err() != nil:
+			return defaultTimestamp, err
+		}
+
+		// wait for an election or for the leader to become reachable
+		select {
+		case <-ctx.Done():
+			return defaultTimestamp, ctx.Err()
+		case <-r.done:
+			return defaultTimestamp, ErrClosed
+		case <-time.After(r.opts.HeartbeatInterval):
+		}
+	}
+}
+
+// propose appends e to the log of the leader and waits for it to be
+// applied.
+func (r *ReplicatedClock) propose(ctx context.Context, e raftEntry) (raftResult, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return raftResult{}, ErrClosed
+	}
+	if r.role != raftLeader {
+		r.mu.Unlock()
+		return raftResult{}, errNotLeader
+	}
+
+	e.Term = r.term
+	if err := r.appendLocked(e); err != nil {
+		r.mu.Unlock()
+		return raftResult{}, err
+	}
+	index := r.lastIndex()
+	w := raftWaiter{term: r.term, ch: make(chan raftResult, 1)}
+	r.waiters[index] = w
+	r.advanceCommitLocked()
+	r.mu.Unlock()
+	r.kickAll()
+
+	select {
+	case res := <-w.ch:
+		return res, nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		delete(r.waiters, index)
+		r.mu.Unlock()
+		return raftResult{}, ctx.Err()
+	case <-r.done:
+		return raftResult{}, ErrClosed
+	}
+}
+
+// forward proposes e on the leader.
+func (r *ReplicatedClock) forward(ctx context.Context, leader string, e raftEntry) (raftResult, error) {
+	timeout := 10 * r.opts.ElectionTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	resp, err := r.call(ctx, leader, &raftRequest{Propose: &raftProposal{Entry: e, Timeout: timeout}})
+	if err != nil {
+		return raftResult{}, err
+	}
+	return resp.Result, nil
+}
+
+// Close stops the node. The group carries on as long as a majority of its
+// nodes is running.
+func (r *ReplicatedClock) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClosed
+	}
+	r.closed = true
+	close(r.done)
+	r.applied.Broadcast()
+	err := r.l.Close()
+	for c := range r.conns {
+		c.Close()
+	}
+	r.mu.Unlock()
+
+	for _, p := range r.pools {
+		p.Close()
+	}
+	r.wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cerr := r.logFile.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (r *ReplicatedClock) ticker() {
+	defer r.wg.Done()
+
+	t := time.NewTicker(r.opts.HeartbeatInterval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-t.C:
+		}
+
+		r.mu.Lock()
+		now := time.Now()
+		if r.role == raftLeader {
+			// a leader cut off from the majority steps down, so that
+			// its clients move on to the new leader
+			contacted := 1
+			for _, peer := range r.peers {
+				if now.Sub(r.lastContact[peer]) < r.opts.ElectionTimeout {
+					contacted++
+				}
+			}
+			if !r.isMajority(contacted) {
+				r.becomeFollowerLocked(r.term)
+			}
+		} else if now.After(r.deadline) {
+			r.startElectionLocked()
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *ReplicatedClock) resetDeadline() {
+	d := r.opts.ElectionTimeout
+	r.deadline = time.Now().Add(d + time.Duration(rand.Int63n(int64(d))))
+}
+
+func (r *ReplicatedClock) isMajority(n int) bool {
+	return 2*n > len(r.peers)+1
+}
+
+func (r *ReplicatedClock) startElectionLocked() {
+	r.role = raftCandidate
+	r.term++
+	r.votedFor = r.id
+	r.leader = ""
+	r.resetDeadline()
+	if err := r.persistStateLocked(); err != nil {
+		// stand again once the term can be persisted
+		r.role = raftFollower
+		r.term, r.votedFor = r.term-1, ""
+		return
+	}
+
+	req := &raftRequest{Vote: &raftVoteRequest{
+		Term:      r.term,
+		Candidate: r.id,
+		LastIndex: r.lastIndex(),
+		LastTerm:  r.termAt(r.lastIndex()),
+	}}
+
+	votes := 1
+	if r.isMajority(votes) {
+		r.becomeLeaderLocked()
+		return
+	}
+	r.wg.Add(len(r.peers))
+	for _, peer := range r.peers {
+		go func(peer string) {
+			defer r.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), r.opts.ElectionTimeout)
+			defer cancel()
+			resp, err := r.call(ctx, peer, req)
+			if err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if resp.Term > r.term {
+				r.becomeFollowerLocked(resp.Term)
+				return
+			}
+			if !resp.Granted || r.role != raftCandidate || r.term != req.Vote.Term {
+				return
+			}
+			votes++
+			if r.isMajority(votes) {
+				r.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+func (r *ReplicatedClock) becomeLeaderLocked() {
+	r.role = raftLeader
+	r.leader = r.id
+	now := time.Now()
+	for _, peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+		r.matchIndex[peer] = 0
+		r.lastContact[peer] = now
+	}
+
+	// entries of earlier terms are committed along with one of the
+	// current term
+	if err := r.appendLocked(raftEntry{Term: r.term, Op: raftNoop}); err != nil {
+		r.becomeFollowerLocked(r.term)
+		return
+	}
+	r.advanceCommitLocked()
+	r.kickAll()
+}
+
+// becomeFollowerLocked moves to term as a follower. Proposals waiting on a
+// former leader are failed so that they are retried on the new one. If the
+// new term cannot be persisted, the node steps down in its current term and
+// returns the error: a term a restart would forget could be voted in twice.
+func (r *ReplicatedClock) becomeFollowerLocked(term uint64) error {
+	var err error
+	if term > r.term {
+		prevTerm, prevVote := r.term, r.votedFor
+		r.term, r.votedFor = term, ""
+		if err = r.persistStateLocked(); err != nil {
+			r.term, r.votedFor = prevTerm, prevVote
+		}
+	}
+	if r.role == raftLeader {
+		r.leader = ""
+	}
+	r.role = raftFollower
+	r.resetDeadline()
+
+	for index, w := range r.waiters {
+		w.ch <- raftResult{NotLeader: true}
+		delete(r.waiters, index)
+	}
+	return err
+}
+
+func (r *ReplicatedClock) kickAll() {
+	for _, kick := range r.kick {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicator sends appends, or a snapshot once the entries it needs are
+// compacted, to peer while this node leads.
+func (r *ReplicatedClock) replicator(peer string) {
+	defer r.wg.Done()
+
+	t := time.NewTicker(r.opts.HeartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.kick[peer]:
+		case <-t.C:
+		}
+
+		for r.replicate(peer) {
+		}
+	}
+}
+
+// replicate sends one append or snapshot to peer and reports whether peer
+// is still behind.
+func (r *ReplicatedClock) replicate(peer string) bool {
+	r.mu.Lock()
+	if r.role != raftLeader || r.closed {
+		r.mu.Unlock()
+		return false
+	}
+
+	term := r.term
+	next := r.nextIndex[peer]
+	req := &raftRequest{}
+	if next <= r.snapIndex {
+		req.Snapshot = &raftSnapshotRequest{
+			Term:      term,
+			Leader:    r.id,
+			Index:     r.snapIndex,
+			IndexTerm: r.snapTerm,
+			Data:      r.snapData,
+		}
+	} else {
+		entries := r.log[next-r.snapIndex-1:]
+		if len(entries) > raftMaxAppend {
+			entries = entries[:raftMaxAppend]
+		}
+		req.Append = &raftAppendRequest{
+			Term:      term,
+			Leader:    r.id,
+			PrevIndex: next - 1,
+			PrevTerm:  r.termAt(next - 1),
+			Entries:   append([]raftEntry(nil), entries...),
+			Commit:    r.commitIndex,
+		}
+	}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.ElectionTimeout)
+	defer cancel()
+	resp, err := r.call(ctx, peer, req)
+	if err != nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resp.Term > r.term {
+		r.becomeFollowerLocked(resp.Term)
+		return false
+	}
+	if r.role != raftLeader || r.term != term {
+		return false
+	}
+	r.lastContact[peer] = time.Now()
+
+	switch {
+	case req.Snapshot != nil:
+		r.matchIndex[peer] = max64(r.matchIndex[peer], req.Snapshot.Index)
+		r.nextIndex[peer] = r.matchIndex[peer] + 1
+	case resp.Success:
+		r.matchIndex[peer] = max64(r.matchIndex[peer], req.Append.PrevIndex+uint64(len(req.Append.Entries)))
+		r.nextIndex[peer] = r.matchIndex[peer] + 1
+		r.advanceCommitLocked()
+	default:
+		r.nextIndex[peer] = min64(max64(resp.Hint, 1), r.lastIndex()+1)
+	}
+	return r.nextIndex[peer] <= r.lastIndex()
+}
+
+// advanceCommitLocked commits the entries of the current term stored by a
+// majority, along with every entry before them.
+func (r *ReplicatedClock) advanceCommitLocked() {
+	for n := r.lastIndex(); n > r.commitIndex && n > r.snapIndex; n-- {
+		if r.termAt(n) != r.term {
+			break
+		}
+		count := 1
+		for _, peer := range r.peers {
+			if r.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if r.isMajority(count) {
+			r.commitIndex = n
+			r.applied.Broadcast()
+			return
+		}
+	}
+}
+
+// applier applies committed entries to the Lampstamp and hands their
+// results to the waiting proposals.
+func (r *ReplicatedClock) applier() {
+	defer r.wg.Done()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		for !r.closed && r.lastApplied >= r.commitIndex {
+			r.applied.Wait()
+		}
+		if r.closed {
+			return
+		}
+
+		for r.lastApplied < r.commitIndex {
+			r.lastApplied++
+			e := r.log[r.lastApplied-r.snapIndex-1]
+			res := r.apply(e)
+			if w, ok := r.waiters[r.lastApplied]; ok {
+				delete(r.waiters, r.lastApplied)
+				if w.term != e.Term {
+					res = raftResult{NotLeader: true}
+				}
+				w.ch <- res
+			}
+		}
+
+		if r.lastApplied-r.snapIndex >= uint64(r.opts.SnapshotEntries) {
+			r.compactLocked()
+		}
+	}
+}
+
+func (r *ReplicatedClock) apply(e raftEntry) raftResult {
+	var res raftResult
+	switch e.Op {
+	case raftGet:
+		res.Value = r.sm.Get(e.Key)
+	case raftInc:
+		res.Value = r.sm.Inc(e.Key)
+	case raftTick:
+		res.Value = r.sm.Tick(e.Key, e.Timestamp)
+	case raftValidateAndTick:
+		var err error
+		res.Value, err = r.sm.ValidateAndTick(e.Key, e.Timestamp)
+		res.Stale = err != nil
+	case raftLease:
+		res.Value = r.sm.Lease(e.Key, e.Timestamp, e.N)
+	}
+	return res
+}
+
+func (r *ReplicatedClock) serve() {
+	defer r.wg.Done()
+
+	for {
+		conn, err := r.l.Accept()
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			conn.Close()
+			return
+		}
+		r.conns[conn] = struct{}{}
+		r.mu.Unlock()
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer func() {
+				r.mu.Lock()
+				delete(r.conns, conn)
+				r.mu.Unlock()
+				conn.Close()
+			}()
+			if r.admit(conn) {
+				r.serveConn(conn)
+			}
+		}()
+	}
+}
+
+// admit reports whether conn comes from the host of a peer and, with a
+// Secret, whether it answers the challenge of this node.
+func (r *ReplicatedClock) admit(conn net.Conn) bool {
+	if !r.isPeerHost(conn.RemoteAddr()) {
+		return false
+	}
+	if r.opts.Secret == "" {
+		return true
+	}
+
+	nonce := make([]byte, raftNonceSize)
+	if _, err := crand.Read(nonce); err != nil {
+		return false
+	}
+	if err := conn.SetDeadline(time.Now().Add(r.opts.ElectionTimeout)); err != nil {
+		return false
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return false
+	}
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, sum); err != nil {
+		return false
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return false
+	}
+	return hmac.Equal(sum, r.mac(nonce))
+}
+
+// authenticate answers the challenge of the peer cc is connected to.
+func (r *ReplicatedClock) authenticate(cc *clientConn) error {
+	nonce := make([]byte, raftNonceSize)
+	if _, err := io.ReadFull(cc.r, nonce); err != nil {
+		return err
+	}
+	if _, err := cc.w.Write(r.mac(nonce)); err != nil {
+		return err
+	}
+	return cc.w.Flush()
+}
+
+func (r *ReplicatedClock) mac(nonce []byte) []byte {
+	h := hmac.New(sha256.New, []byte(r.opts.Secret))
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+// isPeerHost reports whether addr is an address of the host of a peer.
+// Peers are resolved on every call, so that they may move.
+func (r *ReplicatedClock) isPeerHost(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, peer := range r.opts.Peers {
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(tcp.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *ReplicatedClock) serveConn(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	for {
+		var req raftRequest
+		if err := gob.NewDecoder(br).Decode(&req); err != nil {
+			return
+		}
+
+		resp := r.handle(&req)
+		if err := gob.NewEncoder(bw).Encode(resp); err != nil {
+			return
+		}
+		if err := bw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (r *ReplicatedClock) handle(req *raftRequest) *raftResponse {
+	if req.Propose != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), req.Propose.Timeout)
+		defer cancel()
+
+		res, err := r.propose(ctx, req.Propose.Entry)
+		switch {
+		case errors.Is(err, errNotLeader) || errors.Is(err, ErrClosed):
+			// the caller retries on the next leader
+			res.NotLeader = true
+		case err != nil:
+			res.Err = err.Error()
+		}
+		return &raftResponse{Result: res}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case req.Vote != nil:
+		return r.handleVoteLocked(req.Vote)
+	case req.Append != nil:
+		return r.handleAppendLocked(req.Append)
+	case req.Snapshot != nil:
+		return r.handleSnapshotLocked(req.Snapshot)
+	}
+	return &raftResponse{Term: r.term}
+}
+
+func (r *ReplicatedClock) handleVoteLocked(req *raftVoteRequest) *raftResponse {
+	if req.Term > r.term {
+		if err := r.becomeFollowerLocked(req.Term); err != nil {
+			return &raftResponse{Term: r.term}
+		}
+	}
+
+	resp := &raftResponse{Term: r.term}
+	lastTerm := r.termAt(r.lastIndex())
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastIndex >= r.lastIndex())
+	if req.Term == r.term && (r.votedFor == "" || r.votedFor == req.Candidate) && upToDate {
+		r.votedFor = req.Candidate
+		if r.persistStateLocked() == nil {
+			r.resetDeadline()
+			resp.Granted = true
+		}
+	}
+	return resp
+}
+
+func (r *ReplicatedClock) handleAppendLocked(req *raftAppendRequest) *raftResponse {
+	if req.Term < r.term {
+		return &raftResponse{Term: r.term}
+	}
+	if req.Term > r.term || r.role != raftFollower {
+		if err := r.becomeFollowerLocked(req.Term); err != nil {
+			return &raftResponse{Term: r.term}
+		}
+	}
+	r.leader = req.Leader
+	r.resetDeadline()
+	resp := &raftResponse{Term: r.term}
+
+	// entries up to the snapshot are committed and known to match
+	prev, entries := req.PrevIndex, req.Entries
+	if prev < r.snapIndex {
+		skip := min64(r.snapIndex-prev, uint64(len(entries)))
+		prev, entries = prev+skip, entries[skip:]
+		if prev < r.snapIndex {
+			resp.Hint = r.snapIndex + 1
+			return resp
+		}
+	}
+
+	if prev > r.lastIndex() {
+		resp.Hint = r.lastIndex() + 1
+		return resp
+	}
+	if term := r.termAt(prev); term != req.PrevTerm && prev > r.snapIndex {
+		// skip back over the whole conflicting term
+		hint := prev
+		for hint > r.snapIndex+1 && r.termAt(hint-1) == term {
+			hint--
+		}
+		resp.Hint = hint
+		return resp
+	}
+
+	for i, e := range entries {
+		index := prev + 1 + uint64(i)
+		if index <= r.lastIndex() {
+			if r.termAt(index) == e.Term {
+				continue
+			}
+			if err := r.truncateLocked(index); err != nil {
+				return resp
+			}
+		}
+		if err := r.appendLocked(entries[i:]...); err != nil {
+			return resp
+		}
+		break
+	}
+
+	if last := prev + uint64(len(entries)); req.Commit > r.commitIndex {
+		r.commitIndex = max64(r.commitIndex, min64(req.Commit, last))
+		r.applied.Broadcast()
+	}
+	resp.Success = true
+	return resp
+}
+
+func (r *ReplicatedClock) handleSnapshotLocked(req *raftSnapshotRequest) *raftResponse {
+	if req.Term < r.term {
+		return &raftResponse{Term: r.term}
+	}
+	if req.Term > r.term || r.role != raftFollower {
+		if err := r.becomeFollowerLocked(req.Term); err != nil {
+			return &raftResponse{Term: r.term}
+		}
+	}
+	r.leader = req.Leader
+	r.resetDeadline()
+	resp := &raftResponse{Term: r.term}
+
+	if req.Index <= r.lastApplied {
+		return resp
+	}
+	if err := r.sm.Restore(bytes.NewReader(req.Data)); err != nil {
+		return resp
+	}
+
+	if req.Index <= r.lastIndex() && r.termAt(req.Index) == req.IndexTerm {
+		r.log = append([]raftEntry(nil), r.log[req.Index-r.snapIndex:]...)
+	} else {
+		r.log = nil
+	}
+	r.snapIndex, r.snapTerm, r.snapData = req.Index, req.IndexTerm, req.Data
+	r.commitIndex = max64(r.commitIndex, req.Index)
+	r.lastApplied = req.Index
+
+	if err := r.persistSnapshotLocked(); err != nil {
+		return resp
+	}
+	return resp
+}
+
+// call sends req to peer and waits for its response.
+func (r *ReplicatedClock) call(ctx context.Context, peer string, req *raftRequest) (*raftResponse, error) {
+	pool, ok := r.pools[peer]
+	if !ok {
+		return nil, fmt.Errorf("unknown node %q", peer)
+	}
+
+	resp := &raftResponse{}
+	err := pool.do(ctx, func(cc *clientConn) error {
+		if err := gob.NewEncoder(cc.w).Encode(req); err != nil {
+			return err
+		}
+		if err := cc.w.Flush(); err != nil {
+			return err
+		}
+		return gob.NewDecoder(cc.r).Decode(resp)
+	})
+	return resp, err
+}
+
+func (r *ReplicatedClock) lastIndex() uint64 {
+	return r.snapIndex + uint64(len(r.log))
+}
+
+// termAt returns the term of the entry at index, which must not be below
+// the snapshot.
+func (r *ReplicatedClock) termAt(index uint64) uint64 {
+	if index == r.snapIndex {
+		return r.snapTerm
+	}
+	return r.log[index-r.snapIndex-1].Term
+}
+
+// Persistence: raft.state holds the term and vote, raft.snap the index and
+// term of the last compacted entry followed by a Lampstamp snapshot, and
+// raft.log the index of its first entry followed by one record per entry:
+// len(payload) | payload | crc32. Entries are fsynced before they count
+// towards a majority or are acknowledged to a leader.
+
+func (r *ReplicatedClock) load() error {
+	dir := r.opts.Dir
+
+	if data, err := os.ReadFile(filepath.Join(dir, raftSnapshotFile)); err == nil {
+		br := bytes.NewReader(data)
+		index, err1 := binary.ReadUvarint(br)
+		term, err2 := binary.ReadUvarint(br)
+		if err1 != nil || err2 != nil {
+			return ErrWALCorrupt
+		}
+		r.snapData = data[len(data)-br.Len():]
+		if err := r.sm.Restore(bytes.NewReader(r.snapData)); err != nil {
+			return err
+		}
+		r.snapIndex, r.snapTerm = index, term
+		r.commitIndex, r.lastApplied = index, index
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, raftStateFile)); err == nil {
+		br := bytes.NewReader(data)
+		term, err := binary.ReadUvarint(br)
+		if err != nil {
+			return ErrWALCorrupt
+		}
+		vote, err := readString(br)
+		if err != nil {
+			return ErrWALCorrupt
+		}
+		r.term, r.votedFor = term, vote
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	path := filepath.Join(dir, raftLogFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r.rewriteLogLocked()
+	}
+	if err != nil {
+		return err
+	}
+
+	br := bytes.NewReader(data)
+	first, err := binary.ReadUvarint(br)
+	if err != nil {
+		return r.rewriteLogLocked()
+	}
+	if first > r.snapIndex+1 {
+		return fmt.Errorf("%w: log starts at %d after snapshot at %d", ErrWALCorrupt, first, r.snapIndex)
+	}
+
+	index := first
+	valid := len(data) - br.Len()
+	for br.Len() > 0 {
+		e, err := decodeRaftEntry(br)
+		if err != nil {
+			// a torn tail was never acknowledged, but entries after a
+			// damaged record may have been
+			if hasRaftEntry(data[valid+1:]) {
+				return fmt.Errorf("%w: %s at offset %d", ErrWALCorrupt, path, valid)
+			}
+			break
+		}
+		if index > r.snapIndex {
+			r.log = append(r.log, e)
+		}
+		index++
+		valid = len(data) - br.Len()
+	}
+
+	if valid < len(data) {
+		if err := os.Truncate(path, int64(valid)); err != nil {
+			return err
+		}
+	}
+	r.logFile, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+func (r *ReplicatedClock) persistStateLocked() error {
+	var buf bytes.Buffer
+	writeUvarint(&buf, r.term)
+	writeString(&buf, r.votedFor)
+	return writeFileAtomic(filepath.Join(r.opts.Dir, raftStateFile), buf.Bytes())
+}
+
+// appendLocked adds entries to the log and fsyncs them.
+func (r *ReplicatedClock) appendLocked(entries ...raftEntry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		encodeRaftEntry(&buf, e)
+	}
+	if _, err := r.logFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := r.logFile.Sync(); err != nil {
+		return err
+	}
+	r.log = append(r.log, entries...)
+	return nil
+}
+
+// truncateLocked drops the entries from index on, which conflict with the
+// log of the leader.
+func (r *ReplicatedClock) truncateLocked(index uint64) error {
+	r.log = r.log[:index-r.snapIndex-1]
+	return r.rewriteLogLocked()
+}
+
+// compactLocked replaces the applied entries with a snapshot.
+func (r *ReplicatedClock) compactLocked() error {
+	var buf bytes.Buffer
+	if err := r.sm.Snapshot(&buf); err != nil {
+		return err
+	}
+
+	r.snapTerm = r.termAt(r.lastApplied)
+	r.log = append([]raftEntry(nil), r.log[r.lastApplied-r.snapIndex:]...)
+	r.snapIndex = r.lastApplied
+	r.snapData = buf.Bytes()
+	return r.persistSnapshotLocked()
+}
+
+// persistSnapshotLocked writes the snapshot and then the log following it,
+// so that a crash in between leaves a log overlapping the snapshot.
+func (r *ReplicatedClock) persistSnapshotLocked() error {
+	var buf bytes.Buffer
+	writeUvarint(&buf, r.snapIndex)
+	writeUvarint(&buf, r.snapTerm)
+	buf.Write(r.snapData)
+	if err := writeFileAtomic(filepath.Join(r.opts.Dir, raftSnapshotFile), buf.Bytes()); err != nil {
+		return err
+	}
+	return r.rewriteLogLocked()
+}
+
+func (r *ReplicatedClock) rewriteLogLocked() error {
+	var buf bytes.Buffer
+	writeUvarint(&buf, r.snapIndex+1)
+	for _, e := range r.log {
+		encodeRaftEntry(&buf, e)
+	}
+
+	path := filepath.Join(r.opts.Dir, raftLogFile)
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return err
+	}
+	if r.logFile != nil {
+		r.logFile.Close()
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	r.logFile = f
+	return nil
+}
+
+func encodeRaftEntry(buf *bytes.Buffer, e raftEntry) {
+	var payload bytes.Buffer
+	writeUvarint(&payload, e.Term)
+	payload.WriteByte(byte(e.Op))
+	writeString(&payload, e.Key)
+	writeVarint(&payload, e.Timestamp)
+	writeVarint(&payload, e.N)
+
+	writeUvarint(buf, uint64(payload.Len()))
+	buf.Write(payload.Bytes())
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(payload.Bytes()))
+	buf.Write(sum[:])
+}
+
+func decodeRaftEntry(br *bytes.Reader) (raftEntry, error) {
+	var e raftEntry
+
+	n, err := binary.ReadUvarint(br)
+	if err != nil || n > uint64(br.Len()) {
+		return e, ErrWALCorrupt
+	}
+	payload := make([]byte, n)
+	var sum [4]byte
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return e, ErrWALCorrupt
+	}
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return e, ErrWALCorrupt
+	}
+	if binary.BigEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(payload) {
+		return e, ErrWALCorrupt
+	}
+
+	pr := bytes.NewReader(payload)
+	if e.Term, err = binary.ReadUvarint(pr); err != nil {
+		return e, ErrWALCorrupt
+	}
+	op, err := pr.ReadByte()
+	if err != nil {
+		return e, ErrWALCorrupt
+	}
+	e.Op = raftOp(op)
+	if e.Key, err = readString(pr); err != nil {
+		return e, ErrWALCorrupt
+	}
+	if e.Timestamp, err = binary.ReadVarint(pr); err != nil {
+		return e, ErrWALCorrupt
+	}
+	if e.N, err = binary.ReadVarint(pr); err != nil {
+		return e, ErrWALCorrupt
+	}
+	return e, nil
+}
+
+// hasRaftEntry reports whether a valid record starts anywhere in data, as
+// hasWALRecord does for the write-ahead log.
+func hasRaftEntry(data []byte) bool {
+	for off := range data {
+		if _, err := decodeRaftEntry(bytes.NewReader(data[off:])); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func max64(x, y uint64) uint64 {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+func min64(x, y uint64) uint64 {
+	if x < y {
+		return x
+	}
+	return y
+}
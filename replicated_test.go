@@ -0,0 +1,528 @@
+package lampstamp
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testElectionTimeout = 150 * time.Millisecond
+
+// testCluster runs a replicated group in process over loopback. Nodes can
+// be killed, restarted and cut off from each other.
+type testCluster struct {
+	t     *testing.T
+	ro    ReplicatedOptions
+	addrs []string
+	dirs  []string
+	nodes []*ReplicatedClock
+
+	mu  sync.Mutex
+	cut map[[2]int]bool
+}
+
+func newTestCluster(t *testing.T, n int, ro ReplicatedOptions) *testCluster {
+	c := &testCluster{t: t, ro: ro, cut: make(map[[2]int]bool)}
+	if c.ro.ElectionTimeout == 0 {
+		c.ro.ElectionTimeout = testElectionTimeout
+	}
+
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i] = l
+		c.addrs = append(c.addrs, l.Addr().String())
+		c.dirs = append(c.dirs, t.TempDir())
+	}
+	c.nodes = make([]*ReplicatedClock, n)
+	for i, l := range listeners {
+		c.open(i, l)
+	}
+
+	t.Cleanup(func() {
+		for i := range c.nodes {
+			c.kill(i)
+		}
+	})
+	return c
+}
+
+func (c *testCluster) open(i int, l net.Listener) {
+	ro := c.ro
+	ro.ID, ro.Peers, ro.Dir = c.addrs[i], c.addrs, c.dirs[i]
+	ro.Dial = func(ctx context.Context, addr string) (net.Conn, error) {
+		j := c.index(addr)
+		if c.isCut(i, j) {
+			return nil, errors.New("partitioned")
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return &partitionConn{Conn: conn, c: c, from: i, to: j}, nil
+	}
+
+	node, err := OpenReplicated(l, ro)
+	require.NoError(c.t, err)
+	c.nodes[i] = node
+}
+
+func (c *testCluster) index(addr string) int {
+	for i, a := range c.addrs {
+		if a == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// kill stops node i, as if its process had died.
+func (c *testCluster) kill(i int) {
+	if c.nodes[i] != nil {
+		c.nodes[i].Close()
+		c.nodes[i] = nil
+	}
+}
+
+// restart starts node i again from its directory.
+func (c *testCluster) restart(i int) {
+	l, err := net.Listen("tcp", c.addrs[i])
+	require.NoError(c.t, err)
+	c.open(i, l)
+}
+
+// partition cuts the links between the nodes of group and all others.
+func (c *testCluster) partition(group ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	in := make(map[int]bool)
+	for _, i := range group {
+		in[i] = true
+	}
+	for i := range c.addrs {
+		for j := range c.addrs {
+			if in[i] != in[j] {
+				c.cut[[2]int{i, j}] = true
+			}
+		}
+	}
+}
+
+func (c *testCluster) heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cut = make(map[[2]int]bool)
+}
+
+func (c *testCluster) isCut(i, j int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cut[[2]int{i, j}]
+}
+
+// leader waits for the running nodes outside of except to agree on a
+// leader and returns its index.
+func (c *testCluster) leader(except ...int) int {
+	c.t.Helper()
+
+	skip := make(map[int]bool)
+	for _, i := range except {
+		skip[i] = true
+	}
+
+	leader := -1
+	require.Eventually(c.t, func() bool {
+		leader = -1
+		for i, node := range c.nodes {
+			if node == nil || skip[i] {
+				continue
+			}
+			l := c.index(node.Leader())
+			if l < 0 || (leader >= 0 && l != leader) || skip[l] {
+				return false
+			}
+			leader = l
+		}
+		return leader >= 0 && c.nodes[leader] != nil
+	}, 10*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+// partitionConn fails once the link it runs over is cut.
+type partitionConn struct {
+	net.Conn
+	c        *testCluster
+	from, to int
+}
+
+func (p *partitionConn) Read(b []byte) (int, error) {
+	if p.c.isCut(p.from, p.to) {
+		p.Conn.Close()
+		return 0, errors.New("partitioned")
+	}
+	return p.Conn.Read(b)
+}
+
+func (p *partitionConn) Write(b []byte) (int, error) {
+	if p.c.isCut(p.from, p.to) {
+		p.Conn.Close()
+		return 0, errors.New("partitioned")
+	}
+	return p.Conn.Write(b)
+}
+
+func testCtx(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestReplicatedClock(t *testing.T) {
+	c := newTestCluster(t, 3, ReplicatedOptions{})
+	ctx := testCtx(t, 10*time.Second)
+
+	// every node serves requests, forwarding them to the leader
+	for i, node := range c.nodes {
+		ts, err := node.IncCtx(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, int64(i+1), ts)
+	}
+
+	node := c.nodes[(c.leader()+1)%3]
+	ts, err := node.TickCtx(ctx, "a", 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), ts)
+
+	ts, err = node.ValidateAndTickCtx(ctx, "a", 5)
+	var stale *StaleError
+	require.ErrorAs(t, err, &stale)
+	assert.Equal(t, int64(11), stale.Current)
+	assert.Equal(t, int64(11), ts)
+
+	ts, err = node.ValidateAndTickCtx(ctx, "a", 11)
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), ts)
+
+	ts, err = node.LeaseCtx(ctx, "a", 20, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(30), ts)
+
+	for _, node := range c.nodes {
+		ts, err := node.GetCtx(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, int64(30), ts)
+	}
+}
+
+func TestReplicatedClockLeaderFailure(t *testing.T) {
+	for _, n := range []int{3, 5} {
+		n := n
+		t.Run(map[int]string{3: "3 nodes", 5: "5 nodes"}[n], func(t *testing.T) {
+			c := newTestCluster(t, n, ReplicatedOptions{})
+			ctx := testCtx(t, 20*time.Second)
+
+			var last int64
+			var killed []int
+			// a group of n nodes outlives the loss of (n-1)/2 leaders
+			for round := 0; round < (n-1)/2; round++ {
+				leader := c.leader(killed...)
+				for i := 0; i < 10; i++ {
+					ts, err := c.nodes[leader].IncCtx(ctx, "a")
+					require.NoError(t, err)
+					require.Greater(t, ts, last)
+					last = ts
+				}
+
+				c.kill(leader)
+				killed = append(killed, leader)
+
+				// acknowledged ticks survive the leader
+				for i, node := range c.nodes {
+					if node == nil {
+						continue
+					}
+					ts, err := node.IncCtx(ctx, "a")
+					require.NoError(t, err, "node %d", i)
+					require.Greater(t, ts, last)
+					last = ts
+				}
+			}
+		})
+	}
+}
+
+func TestReplicatedClockNoMajority(t *testing.T) {
+	c := newTestCluster(t, 3, ReplicatedOptions{})
+
+	ts, err := c.nodes[0].IncCtx(testCtx(t, 10*time.Second), "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), ts)
+
+	c.kill(1)
+	c.kill(2)
+	_, err = c.nodes[0].IncCtx(testCtx(t, 5*testElectionTimeout), "a")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the lost majority comes back with its state; the tick that timed out
+	// may have been applied meanwhile
+	c.restart(2)
+	ts, err = c.nodes[0].IncCtx(testCtx(t, 10*time.Second), "a")
+	require.NoError(t, err)
+	assert.Contains(t, []int64{2, 3}, ts)
+}
+
+func TestReplicatedClockPartition(t *testing.T) {
+	c := newTestCluster(t, 5, ReplicatedOptions{})
+	ctx := testCtx(t, 20*time.Second)
+
+	old := c.leader()
+	ts, err := c.nodes[old].IncCtx(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), ts)
+
+	// the old leader and one follower are the minority
+	follower := (old + 1) % 5
+	c.partition(old, follower)
+
+	_, err = c.nodes[follower].IncCtx(testCtx(t, 5*testElectionTimeout), "a")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	leader := c.leader(old, follower)
+	for i := 2; i <= 10; i++ {
+		ts, err := c.nodes[leader].IncCtx(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, int64(i), ts)
+	}
+
+	// the minority catches up once the partition heals
+	c.heal()
+	for _, i := range []int{old, follower} {
+		ts, err := c.nodes[i].IncCtx(ctx, "a")
+		require.NoError(t, err)
+		assert.Greater(t, ts, int64(10))
+	}
+}
+
+func TestReplicatedClockSnapshot(t *testing.T) {
+	c := newTestCluster(t, 3, ReplicatedOptions{SnapshotEntries: 10})
+	ctx := testCtx(t, 20*time.Second)
+
+	leader := c.leader()
+	lagging := (leader + 1) % 3
+	c.kill(lagging)
+
+	for i := 1; i <= 100; i++ {
+		ts, err := c.nodes[leader].IncCtx(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, int64(i), ts)
+	}
+
+	// the lagging node is sent a snapshot, as the log it needs has been
+	// compacted, and is then needed for a majority
+	c.restart(lagging)
+	require.Eventually(t, func() bool {
+		c.nodes[lagging].mu.Lock()
+		defer c.nodes[lagging].mu.Unlock()
+		return c.nodes[lagging].lastApplied >= 100
+	}, 10*time.Second, 10*time.Millisecond)
+	c.kill((lagging + 1) % 3)
+
+	ts, err := c.nodes[lagging].IncCtx(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(101), ts)
+}
+
+func TestReplicatedClockRestart(t *testing.T) {
+	c := newTestCluster(t, 3, ReplicatedOptions{SnapshotEntries: 25})
+	ctx := testCtx(t, 20*time.Second)
+
+	for i := 1; i <= 60; i++ {
+		ts, err := c.nodes[i%3].IncCtx(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, int64(i), ts)
+	}
+
+	for i := range c.nodes {
+		c.kill(i)
+	}
+	for i := range c.nodes {
+		c.restart(i)
+	}
+
+	ts, err := c.nodes[0].GetCtx(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(60), ts)
+	ts, err = c.nodes[1].IncCtx(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(61), ts)
+}
+
+func TestReplicatedClockConcurrent(t *testing.T) {
+	c := newTestCluster(t, 3, ReplicatedOptions{})
+	ctx := testCtx(t, 30*time.Second)
+	leader := c.leader()
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[int64]bool)
+		wg   sync.WaitGroup
+	)
+	for i := range c.nodes {
+		if i == leader {
+			continue
+		}
+		node := c.nodes[i]
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					ts, err := node.IncCtx(ctx, "a")
+					if !assert.NoError(t, err) {
+						return
+					}
+					mu.Lock()
+					assert.False(t, seen[ts], "timestamp %d issued twice", ts)
+					seen[ts] = true
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	c.kill(leader)
+	wg.Wait()
+	assert.Len(t, seen, 400)
+}
+
+func TestReplicatedClockCorruptLog(t *testing.T) {
+	c := newTestCluster(t, 1, ReplicatedOptions{})
+	ctx := testCtx(t, 10*time.Second)
+	for i := 0; i < 10; i++ {
+		_, err := c.nodes[0].IncCtx(ctx, "a")
+		require.NoError(t, err)
+	}
+	c.kill(0)
+
+	path := filepath.Join(c.dirs[0], raftLogFile)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// a torn tail is dropped
+	require.NoError(t, os.WriteFile(path, data[:len(data)-2], 0o644))
+	c.restart(0)
+	ts, err := c.nodes[0].GetCtx(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), ts)
+	c.kill(0)
+
+	// while a damaged record followed by acknowledged ones is not
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+	l, err := net.Listen("tcp", c.addrs[0])
+	require.NoError(t, err)
+	defer l.Close()
+	ro := c.ro
+	ro.ID, ro.Peers, ro.Dir = c.addrs[0], c.addrs, c.dirs[0]
+	_, err = OpenReplicated(l, ro)
+	assert.ErrorIs(t, err, ErrWALCorrupt)
+}
+
+// sendVote asks node at addr for its vote in term over a connection from
+// conn, and returns whether it answered.
+func sendVote(t *testing.T, conn net.Conn, term uint64) bool {
+	t.Helper()
+	defer conn.Close()
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	req := &raftRequest{Vote: &raftVoteRequest{Term: term, Candidate: "intruder"}}
+	if err := gob.NewEncoder(conn).Encode(req); err != nil {
+		return false
+	}
+	var resp raftResponse
+	return gob.NewDecoder(bufio.NewReader(conn)).Decode(&resp) == nil
+}
+
+func TestReplicatedClockPeersOnly(t *testing.T) {
+	c := newTestCluster(t, 1, ReplicatedOptions{})
+
+	// 127.0.0.2 is this host too, but not a peer
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	conn, err := d.Dial("tcp", c.addrs[0])
+	require.NoError(t, err)
+	assert.False(t, sendVote(t, conn, 1<<20))
+
+	conn, err = net.Dial("tcp", c.addrs[0])
+	require.NoError(t, err)
+	assert.True(t, sendVote(t, conn, 1<<20))
+}
+
+func TestReplicatedClockSecret(t *testing.T) {
+	c := newTestCluster(t, 3, ReplicatedOptions{Secret: "s3cret"})
+	ctx := testCtx(t, 10*time.Second)
+
+	for i, node := range c.nodes {
+		ts, err := node.IncCtx(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, int64(i+1), ts)
+	}
+
+	// a peer that does not know the secret is not served
+	conn, err := net.Dial("tcp", c.addrs[0])
+	require.NoError(t, err)
+	nonce := make([]byte, raftNonceSize)
+	_, err = io.ReadFull(conn, nonce)
+	require.NoError(t, err)
+	intruder := &ReplicatedClock{opts: ReplicatedOptions{Secret: "guess"}}
+	_, err = conn.Write(intruder.mac(nonce))
+	require.NoError(t, err)
+	assert.False(t, sendVote(t, conn, 1<<20))
+
+	ts, err := c.nodes[0].IncCtx(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), ts)
+}
+
+func TestReplicatedClockPersistFailure(t *testing.T) {
+	c := newTestCluster(t, 1, ReplicatedOptions{})
+	node := c.nodes[0]
+	c.leader()
+
+	// the state file cannot be replaced while its temporary file is a
+	// directory
+	tmp := filepath.Join(c.dirs[0], raftStateFile+".tmp")
+	require.NoError(t, os.Mkdir(tmp, 0o755))
+
+	node.mu.Lock()
+	term := node.term
+	node.mu.Unlock()
+	resp := node.handle(&raftRequest{Vote: &raftVoteRequest{Term: term + 1, Candidate: "other", LastIndex: 1 << 20, LastTerm: term + 1}})
+	assert.False(t, resp.Granted)
+	assert.Equal(t, term, resp.Term)
+	assert.Equal(t, "", node.Leader())
+
+	// the node may have stood for election meanwhile
+	require.NoError(t, os.Remove(tmp))
+	resp = node.handle(&raftRequest{Vote: &raftVoteRequest{Term: term + 100, Candidate: "other", LastIndex: 1 << 20, LastTerm: term + 100}})
+	assert.True(t, resp.Granted)
+	assert.Equal(t, term+100, resp.Term)
+}
@@ -0,0 +1,282 @@
+package lampstamp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type ReservedOptions struct {
+	// Step is how far beyond an issued timestamp a reservation reaches,
+	// so that one disk write covers Step ticks. 1000 by default.
+	Step int64
+	// PerKey keeps a reservation per key instead of a single global one.
+	// Restarts then only jump keys by their own reservation, at the cost
+	// of one disk write per Step ticks of every key.
+	PerKey bool
+	// CompactSize is the file size at which reservations of keys that are
+	// no longer held are folded into the global one and the file is
+	// rewritten. 1MiB by default.
+	CompactSize int64
+}
+
+const (
+	defaultReserveStep = 1000
+	defaultCompactSize = 1 << 20
+
+	// globalReservation is the key under which the global reservation is
+	// stored. Per-key reservations fall back to it for unknown keys.
+	globalReservation = ""
+)
+
+// ReservedLampstamp is a Lampstamp that persists only an upper bound of the
+// timestamps it issues. A timestamp is returned once a reservation covering
+// it is on disk, and reopening the file moves every key to its reservation,
+// so restarts never go backwards while only one in Step ticks waits for an
+// fsync.
+//
+// The file is a log of WAL records (key, bound); the highest bound of each
+// key wins and a torn record at the end is ignored; a damaged record
+// anywhere else fails OpenReserved with ErrWALCorrupt.
+type ReservedLampstamp struct {
+	ts   *Lampstamp
+	path string
+	opts ReservedOptions
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	global int64
+	bounds map[string]int64
+	closed bool
+}
+
+var (
+	_ Clock  = (*ReservedLampstamp)(nil)
+	_ Leaser = (*ReservedLampstamp)(nil)
+)
+
+func OpenReserved(path string, ro ReservedOptions, opts ...Option) (*ReservedLampstamp, error) {
+	if ro.Step <= 0 {
+		ro.Step = defaultReserveStep
+	}
+	if ro.CompactSize <= 0 {
+		ro.CompactSize = defaultCompactSize
+	}
+
+	r := &ReservedLampstamp{
+		ts:     NewLampstamp(opts...),
+		path:   path,
+		opts:   ro,
+		bounds: make(map[string]int64),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	r.ts.raiseFloor(r.global)
+	for key, bound := range r.bounds {
+		r.ts.advance(key, bound)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	r.f = f
+	return r, nil
+}
+
+// load reads the reservations and cuts off a torn record left by a crash.
+// A bad record followed by valid ones means the file is corrupt.
+func (r *ReservedLampstamp) load() error {
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	off := 0
+	for off < len(data) {
+		key, bound, n, err := decodeWALRecord(data[off:])
+		if err != nil {
+			if hasWALRecord(data[off+1:]) {
+				return fmt.Errorf("%w: %s at offset %d", ErrWALCorrupt, r.path, off)
+			}
+			break
+		}
+		if key == globalReservation {
+			r.global = max(r.global, bound)
+		} else {
+			r.bounds[key] = max(r.bounds[key], bound)
+		}
+		off += n
+	}
+	r.size = int64(off)
+
+	if off < len(data) {
+		return os.Truncate(r.path, int64(off))
+	}
+	return nil
+}
+
+func (r *ReservedLampstamp) Get(key string) int64 {
+	return r.ts.Get(key)
+}
+
+func (r *ReservedLampstamp) Inc(key string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return defaultTimestamp, ErrClosed
+	}
+	val := r.ts.Inc(key)
+	return val, r.reserve(key, val)
+}
+
+func (r *ReservedLampstamp) Tick(key string, requestTimestamp int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return defaultTimestamp, ErrClosed
+	}
+	val := r.ts.Tick(key, requestTimestamp)
+	return val, r.reserve(key, val)
+}
+
+func (r *ReservedLampstamp) ValidateAndTick(key string, requestTimestamp int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return defaultTimestamp, ErrClosed
+	}
+	val, err := r.ts.ValidateAndTick(key, requestTimestamp)
+	if err != nil {
+		return val, err
+	}
+	return val, r.reserve(key, val)
+}
+
+func (r *ReservedLampstamp) Lease(key string, min, n int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return defaultTimestamp, ErrClosed
+	}
+	val := r.ts.Lease(key, min, n)
+	return val, r.reserve(key, val)
+}
+
+func (r *ReservedLampstamp) GetCtx(ctx context.Context, key string) (int64, error) {
+	return r.ts.GetCtx(ctx, key)
+}
+
+func (r *ReservedLampstamp) IncCtx(ctx context.Context, key string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return r.Inc(key)
+}
+
+func (r *ReservedLampstamp) TickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return r.Tick(key, requestTimestamp)
+}
+
+func (r *ReservedLampstamp) ValidateAndTickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return r.ValidateAndTick(key, requestTimestamp)
+}
+
+func (r *ReservedLampstamp) LeaseCtx(ctx context.Context, key string, min, n int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+	return r.Lease(key, min, n)
+}
+
+// reserve makes sure val is covered by a reservation on disk.
+func (r *ReservedLampstamp) reserve(key string, val int64) error {
+	bound, ok := r.bounds[key]
+	if !ok {
+		bound = r.global
+	}
+	if val <= bound {
+		return nil
+	}
+
+	if !r.opts.PerKey {
+		key = globalReservation
+	}
+	bound = val + r.opts.Step
+
+	rec := encodeWALRecord(key, bound)
+	if _, err := r.f.Write(rec); err != nil {
+		return err
+	}
+	if err := r.f.Sync(); err != nil {
+		return err
+	}
+	r.size += int64(len(rec))
+
+	if key == globalReservation {
+		r.global = bound
+	} else {
+		r.bounds[key] = bound
+	}
+
+	if r.size >= r.opts.CompactSize {
+		return r.compact()
+	}
+	return nil
+}
+
+// compact folds the reservations of keys the clock no longer holds into the
+// global one and rewrites the file with what is left.
+func (r *ReservedLampstamp) compact() error {
+	for key, bound := range r.bounds {
+		if _, ok := r.ts.lookup(key); !ok {
+			r.global = max(r.global, bound)
+			delete(r.bounds, key)
+		}
+	}
+
+	data := encodeWALRecord(globalReservation, r.global)
+	for key, bound := range r.bounds {
+		data = append(data, encodeWALRecord(key, bound)...)
+	}
+	if err := writeFileAtomic(r.path, data); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	r.f.Close()
+	r.f = f
+	r.size = int64(len(data))
+	return nil
+}
+
+func (r *ReservedLampstamp) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+	r.closed = true
+	return r.f.Close()
+}
@@ -0,0 +1,189 @@
+package lampstamp
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReservedLampstampReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reserved")
+	r, err := OpenReserved(path, ReservedOptions{Step: 10})
+	require.NoError(t, err)
+
+	for i := 0; i < 25; i++ {
+		_, err := r.Inc("a")
+		require.NoError(t, err)
+	}
+	_, err = r.Inc("b")
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	_, err = r.Inc("a")
+	assert.ErrorIs(t, err, ErrClosed)
+
+	// reservations were made at 1, 12 and 23, each reaching 10 further
+	r, err = OpenReserved(path, ReservedOptions{Step: 10})
+	require.NoError(t, err)
+	assert.EqualValues(t, 33, r.Get("a"))
+	assert.EqualValues(t, 33, r.Get("b"))
+	assert.EqualValues(t, 33, r.Get("unknown"))
+
+	val, err := r.Tick("a", 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 34, val)
+
+	// a lease is reserved as a whole
+	val, err = r.Lease("a", 0, 100)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 134, val)
+	require.NoError(t, r.Close())
+
+	r, err = OpenReserved(path, ReservedOptions{Step: 10})
+	require.NoError(t, err)
+	defer r.Close()
+	assert.EqualValues(t, 144, r.Get("a"))
+}
+
+func TestReservedLampstampPerKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reserved")
+	r, err := OpenReserved(path, ReservedOptions{Step: 10, PerKey: true})
+	require.NoError(t, err)
+
+	for i := 0; i < 25; i++ {
+		_, err := r.Inc("a")
+		require.NoError(t, err)
+	}
+	_, err = r.Inc("b")
+	require.NoError(t, err)
+	_, err = r.ValidateAndTick("b", 0)
+	assert.ErrorIs(t, err, ErrStale)
+	require.NoError(t, r.Close())
+
+	r, err = OpenReserved(path, ReservedOptions{Step: 10, PerKey: true})
+	require.NoError(t, err)
+	defer r.Close()
+	assert.EqualValues(t, 33, r.Get("a"))
+	assert.EqualValues(t, 11, r.Get("b"))
+	assert.EqualValues(t, 0, r.Get("unknown"))
+}
+
+func TestReservedLampstampWritesOncePerStep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reserved")
+	r, err := OpenReserved(path, ReservedOptions{Step: 100})
+	require.NoError(t, err)
+	defer r.Close()
+
+	for i := 0; i < 1000; i++ {
+		_, err := r.Inc(strconv.Itoa(i % 3))
+		require.NoError(t, err)
+	}
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	rec := int64(len(encodeWALRecord(globalReservation, 1000)))
+	assert.LessOrEqual(t, info.Size(), 5*rec)
+}
+
+func TestReservedLampstampCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reserved")
+	ro := ReservedOptions{Step: 5, PerKey: true, CompactSize: 256}
+	r, err := OpenReserved(path, ro, WithEvictor(NewLRUEvictor(4)))
+	require.NoError(t, err)
+
+	issued := make(map[string]int64)
+	for i := 0; i < 500; i++ {
+		key := strconv.Itoa(i % 20)
+		val, err := r.Tick(key, int64(i))
+		require.NoError(t, err)
+		issued[key] = val
+	}
+	assert.LessOrEqual(t, len(r.bounds), 20)
+	require.NoError(t, r.Close())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Less(t, info.Size(), int64(2*256))
+
+	r, err = OpenReserved(path, ro, WithEvictor(NewLRUEvictor(4)))
+	require.NoError(t, err)
+	defer r.Close()
+	for key, val := range issued {
+		assert.Greater(t, r.Get(key), val)
+	}
+}
+
+// TestReservedLampstampCrash replays a workload and, for every write to the
+// reservation file, simulates a crash at each byte of that write. Every
+// timestamp returned before the write must be below what the restarted
+// clock hands out.
+func TestReservedLampstampCrash(t *testing.T) {
+	for _, perKey := range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "reserved")
+		ro := ReservedOptions{Step: 3, PerKey: perKey}
+		r, err := OpenReserved(path, ro, WithEvictor(NewLRUEvictor(3)))
+		require.NoError(t, err)
+
+		issued := make(map[string]int64)
+		var prev []byte
+		for i := 0; i < 60; i++ {
+			before := make(map[string]int64, len(issued))
+			for k, v := range issued {
+				before[k] = v
+			}
+
+			key := strconv.Itoa(i % 5)
+			val, err := r.Tick(key, int64(i/4))
+			require.NoError(t, err)
+			issued[key] = val
+
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			for cut := len(prev); cut <= len(data); cut++ {
+				expected := before
+				if cut == len(data) {
+					expected = issued
+				}
+
+				crashed := filepath.Join(t.TempDir(), "reserved")
+				require.NoError(t, os.WriteFile(crashed, data[:cut], 0o644))
+				restarted, err := OpenReserved(crashed, ro, WithEvictor(NewLRUEvictor(3)))
+				require.NoError(t, err)
+				for k, v := range expected {
+					next, err := restarted.Tick(k, 0)
+					require.NoError(t, err)
+					assert.Greater(t, next, v, "perKey %v, op %d, cut %d, key %s", perKey, i, cut, k)
+				}
+				restarted.Close()
+			}
+			prev = data
+		}
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestReservedLampstampCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reserved")
+	r, err := OpenReserved(path, ReservedOptions{Step: 1, PerKey: true})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := r.Inc(strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, r.Close())
+
+	// a damaged record followed by valid ones is not a torn tail, and
+	// dropping the reservations after it would reissue their timestamps
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	_, err = OpenReserved(path, ReservedOptions{Step: 1, PerKey: true})
+	assert.ErrorIs(t, err, ErrWALCorrupt)
+}
@@ -0,0 +1,359 @@
+package lampstamp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The clock server also speaks a subset of RESP, the Redis protocol, so
+// that any Redis client can use it. A request starting with '*' is read as
+// a RESP command and answered in RESP2, or in RESP3 after HELLO 3:
+//
+//	LGET key       current counter
+//	LINC key       increment
+//	LTICK key ts   tick with a remote timestamp
+//	LCAS key ts    validate-and-tick; a stale ts is rejected with the
+//	               error "STALE <current>"
+//	LLEASE key min n
+//	               lease n counters above min
+//
+// PING, ECHO, HELLO, SELECT 0, CLIENT, COMMAND and QUIT are answered the
+// way Redis clients expect when they connect.
+
+const (
+	// maxRESPBulk and maxRESPElems bound the size of a RESP reply read from
+	// a server.
+	maxRESPBulk  = 16 << 20
+	maxRESPElems = 1 << 20
+
+	// maxRESPArgs and maxRESPArg bound the commands the clock server reads
+	// from its clients, whose arguments are short keys and numbers.
+	maxRESPArgs = 32
+	maxRESPArg  = 4 << 10
+)
+
+// respError is a RESP error reply. Its text starts with an error code such
+// as ERR or STALE.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// readRESPCommand reads a command sent to the clock server, which is a flat
+// array of bulk strings. It takes nothing else, so that a client cannot make
+// the server allocate or recurse on nested or oversized values.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("%w: expected an array of bulk strings", ErrProtocol)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > maxRESPArgs {
+		return nil, fmt.Errorf("%w: invalid command length %q", ErrProtocol, line[1:])
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected an array of bulk strings", ErrProtocol)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxRESPArg {
+			return nil, fmt.Errorf("%w: invalid argument length %q", ErrProtocol, line[1:])
+		}
+
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[size] != '\r' || b[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: unterminated RESP bulk string", ErrProtocol)
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+// readRESP reads a RESP2 or RESP3 value. Simple strings and big numbers
+// are returned as string, bulk and verbatim strings as []byte, integers as
+// int64, doubles as float64, booleans as bool, errors as respError,
+// arrays, sets and pushes as []interface{}, and maps as []interface{} of
+// alternating keys and values. Nulls are returned as nil. It reads replies
+// of servers; requests of clients are read with readRESPCommand.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("%w: empty RESP line", ErrProtocol)
+	}
+
+	kind, body := line[0], line[1:]
+	switch kind {
+	case '+':
+		return body, nil
+	case '(':
+		return body, nil
+	case '-':
+		return respError(body), nil
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid RESP integer %q", ErrProtocol, body)
+		}
+		return n, nil
+	case ',':
+		f, err := strconv.ParseFloat(strings.Replace(body, "inf", "Inf", 1), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid RESP double %q", ErrProtocol, body)
+		}
+		return f, nil
+	case '#':
+		switch body {
+		case "t":
+			return true, nil
+		case "f":
+			return false, nil
+		}
+		return nil, fmt.Errorf("%w: invalid RESP boolean %q", ErrProtocol, body)
+	case '_':
+		return nil, nil
+	case '$', '=', '!':
+		b, err := readRESPBulk(r, body)
+		if err != nil || b == nil {
+			return nil, err
+		}
+		switch kind {
+		case '=':
+			// verbatim strings carry a format like "txt:"
+			if len(b) >= 4 && b[3] == ':' {
+				b = b[4:]
+			}
+		case '!':
+			return respError(b), nil
+		}
+		return b, nil
+	case '*', '~', '>', '%':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > maxRESPElems {
+			return nil, fmt.Errorf("%w: invalid RESP length %q", ErrProtocol, body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if kind == '%' {
+			n *= 2
+		}
+		elems := make([]interface{}, n)
+		for i := range elems {
+			if elems[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("%w: invalid RESP type %q", ErrProtocol, kind)
+}
+
+func readRESPBulk(r *bufio.Reader, size string) ([]byte, error) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n > maxRESPBulk {
+		return nil, fmt.Errorf("%w: invalid RESP length %q", ErrProtocol, size)
+	}
+	if n < 0 {
+		return nil, nil
+	}
+
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return nil, fmt.Errorf("%w: unterminated RESP bulk string", ErrProtocol)
+	}
+	return b[:n], nil
+}
+
+// respWriter writes RESP replies in the protocol version of a connection.
+type respWriter struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (rw *respWriter) simple(s string) {
+	rw.w.WriteString("+" + s + "\r\n")
+}
+
+func (rw *respWriter) error(s string) {
+	rw.w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(s) + "\r\n")
+}
+
+func (rw *respWriter) int(n int64) {
+	rw.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (rw *respWriter) bulk(s string) {
+	rw.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (rw *respWriter) array(n int) {
+	rw.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// mapHeader starts a map of n pairs, which is a flat array in RESP2.
+func (rw *respWriter) mapHeader(n int) {
+	if rw.proto >= 3 {
+		rw.w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+		return
+	}
+	rw.array(2 * n)
+}
+
+// command writes a request as an array of bulk strings.
+func (rw *respWriter) command(args ...string) {
+	rw.array(len(args))
+	for _, arg := range args {
+		rw.bulk(arg)
+	}
+}
+
+// handleRESP reads and answers one RESP command. It returns false when the
+// connection is to be closed.
+func (s *Server) handleRESP(ctx context.Context, r *bufio.Reader, rw *respWriter) bool {
+	args, err := readRESPCommand(r)
+	if err != nil {
+		if errors.Is(err, ErrProtocol) {
+			rw.error("ERR " + err.Error())
+		}
+		return false
+	}
+
+	return s.execRESP(ctx, rw, args)
+}
+
+// respArity is the number of arguments, including the command name, of
+// the RESP commands that take a fixed number.
+var respArity = map[string]int{
+	"LGET": 2, "LINC": 2, "LTICK": 3, "LCAS": 3, "LLEASE": 4, "ECHO": 2, "SELECT": 2,
+}
+
+func (s *Server) execRESP(ctx context.Context, rw *respWriter, args []string) bool {
+	name := strings.ToUpper(args[0])
+	if n, ok := respArity[name]; ok && len(args) != n {
+		rw.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return true
+	}
+
+	var (
+		ts  int64
+		err error
+	)
+	var n int64 = 1
+	if name == "LTICK" || name == "LCAS" || name == "LLEASE" {
+		if ts, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+			rw.error("ERR value is not an integer or out of range")
+			return true
+		}
+	}
+	if name == "LLEASE" {
+		if n, err = strconv.ParseInt(args[3], 10, 64); err != nil || n < 1 {
+			rw.error("ERR value is not an integer or out of range")
+			return true
+		}
+	}
+
+	switch name {
+	case "LGET":
+		ts, err = s.Clock.GetCtx(ctx, args[1])
+	case "LINC":
+		ts, err = s.Clock.IncCtx(ctx, args[1])
+	case "LTICK":
+		ts, err = s.Clock.TickCtx(ctx, args[1], ts)
+	case "LCAS":
+		ts, err = s.Clock.ValidateAndTickCtx(ctx, args[1], ts)
+	case "LLEASE":
+		ts, err = s.lease(ctx, args[1], ts, n)
+	case "PING":
+		if len(args) > 1 {
+			rw.bulk(args[1])
+		} else {
+			rw.simple("PONG")
+		}
+		return true
+	case "ECHO":
+		rw.bulk(args[1])
+		return true
+	case "HELLO":
+		s.hello(rw, args[1:])
+		return true
+	case "SELECT":
+		if args[1] != "0" {
+			rw.error("ERR DB index is out of range")
+		} else {
+			rw.simple("OK")
+		}
+		return true
+	case "CLIENT":
+		rw.simple("OK")
+		return true
+	case "COMMAND":
+		rw.array(0)
+		return true
+	case "QUIT":
+		rw.simple("OK")
+		return false
+	default:
+		rw.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return true
+	}
+
+	var stale *StaleError
+	switch {
+	case errors.As(err, &stale):
+		rw.error("STALE " + strconv.FormatInt(stale.Current, 10))
+	case err != nil:
+		rw.error("ERR " + err.Error())
+	default:
+		rw.int(ts)
+	}
+	return true
+}
+
+func (s *Server) hello(rw *respWriter, args []string) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(args[0])
+		if err != nil || proto < 2 || proto > 3 {
+			rw.error("NOPROTO unsupported protocol version")
+			return
+		}
+		rw.proto = proto
+	}
+
+	rw.mapHeader(6)
+	rw.bulk("server")
+	rw.bulk("lampstampd")
+	rw.bulk("version")
+	rw.bulk("1.0.0")
+	rw.bulk("proto")
+	rw.int(int64(rw.proto))
+	rw.bulk("mode")
+	rw.bulk("standalone")
+	rw.bulk("role")
+	rw.bulk("master")
+	rw.bulk("modules")
+	rw.array(0)
+}
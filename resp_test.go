@@ -0,0 +1,206 @@
+package lampstamp
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type respTestConn struct {
+	t  *testing.T
+	rw *respWriter
+	r  *bufio.Reader
+}
+
+func dialRESP(t *testing.T, addr string) *respTestConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &respTestConn{
+		t:  t,
+		rw: &respWriter{w: bufio.NewWriter(conn), proto: 2},
+		r:  bufio.NewReader(conn),
+	}
+}
+
+// do pipelines cmds and returns their replies.
+func (c *respTestConn) do(cmds ...[]string) []interface{} {
+	c.t.Helper()
+
+	for _, cmd := range cmds {
+		c.rw.command(cmd...)
+	}
+	require.NoError(c.t, c.rw.w.Flush())
+
+	replies := make([]interface{}, len(cmds))
+	for i := range replies {
+		var err error
+		replies[i], err = readRESP(c.r)
+		require.NoError(c.t, err)
+	}
+	return replies
+}
+
+func TestServerRESP(t *testing.T) {
+	lt := NewLampstamp()
+	c := dialRESP(t, startTestServer(t, lt))
+
+	assert.Equal(t, []interface{}{
+		"PONG",
+		[]byte("hi"),
+		int64(0),
+		int64(1),
+		int64(6),
+		respError("STALE 6"),
+		int64(7),
+		int64(7),
+	}, c.do(
+		[]string{"PING"},
+		[]string{"ECHO", "hi"},
+		[]string{"LGET", "msg-id-1"},
+		[]string{"LINC", "msg-id-1"},
+		[]string{"LTICK", "msg-id-1", "5"},
+		[]string{"LCAS", "msg-id-1", "3"},
+		[]string{"lcas", "msg-id-1", "6"},
+		[]string{"LGET", "msg-id-1"},
+	))
+	assert.Equal(t, int64(7), lt.Get("msg-id-1"))
+
+	assert.Equal(t, []interface{}{int64(17), respError("ERR value is not an integer or out of range")},
+		c.do([]string{"LLEASE", "msg-id-1", "0", "10"}, []string{"LLEASE", "msg-id-1", "0", "0"}))
+	assert.Equal(t, int64(17), lt.Get("msg-id-1"))
+
+	// keys are binary safe
+	assert.Equal(t, []interface{}{int64(1)}, c.do([]string{"LINC", "key with\r\nnewline"}))
+	assert.Equal(t, int64(1), lt.Get("key with\r\nnewline"))
+
+	replies := c.do(
+		[]string{"LTICK", "msg-id-1"},
+		[]string{"LTICK", "msg-id-1", "x"},
+		[]string{"FLUSHALL"},
+		[]string{"SELECT", "1"},
+	)
+	for _, reply := range replies {
+		assert.IsType(t, respError(""), reply)
+		assert.True(t, strings.HasPrefix(string(reply.(respError)), "ERR "), reply)
+	}
+
+	assert.Equal(t, []interface{}{"OK", "OK", []interface{}{}},
+		c.do([]string{"SELECT", "0"}, []string{"CLIENT", "SETNAME", "x"}, []string{"COMMAND", "DOCS"}))
+
+	// both protocols on one connection
+	c.rw.w.WriteString("INC msg-id-1\r\n")
+	c.rw.command("LINC", "msg-id-1")
+	require.NoError(t, c.rw.w.Flush())
+	line, err := readLine(c.r)
+	require.NoError(t, err)
+	assert.Equal(t, "OK 18", line)
+	v, err := readRESP(c.r)
+	require.NoError(t, err)
+	assert.Equal(t, int64(19), v)
+
+	assert.Equal(t, []interface{}{"OK"}, c.do([]string{"QUIT"}))
+	_, err = c.r.ReadByte()
+	assert.Error(t, err)
+}
+
+func TestServerRESPHello(t *testing.T) {
+	c := dialRESP(t, startTestServer(t, NewLampstamp()))
+
+	hello := c.do([]string{"HELLO"})[0].([]interface{})
+	require.Len(t, hello, 12)
+	assert.Equal(t, []byte("proto"), hello[4])
+	assert.Equal(t, int64(2), hello[5])
+
+	assert.Equal(t, []interface{}{respError("NOPROTO unsupported protocol version")},
+		c.do([]string{"HELLO", "4"}))
+
+	// RESP3 answers with a map
+	c.rw.command("HELLO", "3")
+	require.NoError(t, c.rw.w.Flush())
+	b, err := c.r.Peek(1)
+	require.NoError(t, err)
+	assert.Equal(t, byte('%'), b[0])
+
+	v, err := readRESP(c.r)
+	require.NoError(t, err)
+	hello = v.([]interface{})
+	require.Len(t, hello, 12)
+	assert.Equal(t, int64(3), hello[5])
+}
+
+func TestServerRESPInvalid(t *testing.T) {
+	addr := startTestServer(t, NewLampstamp())
+
+	// anything but a flat array of short bulk strings is rejected and
+	// closes the connection, before the server allocates for it
+	for _, in := range []string{
+		"*x\r\n",
+		"*1\r\n:1\r\n",
+		"*0\r\n",
+		"*1048576\r\n",
+		"*1\r\n*1\r\n$1\r\na\r\n",
+		"*1\r\n$16777216\r\n",
+	} {
+		c := dialRESP(t, addr)
+		c.rw.w.WriteString(in)
+		c.rw.w.Flush()
+		v, err := readRESP(c.r)
+		require.NoError(t, err, in)
+		assert.IsType(t, respError(""), v, in)
+		_, err = c.r.ReadByte()
+		assert.Error(t, err, in)
+	}
+}
+
+func TestReadRESPCommand(t *testing.T) {
+	args, err := readRESPCommand(bufio.NewReader(strings.NewReader("*3\r\n$5\r\nLTICK\r\n$3\r\na b\r\n$0\r\n\r\n")))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"LTICK", "a b", ""}, args)
+
+	for _, in := range []string{"", "+OK\r\n", "*33\r\n", "*1\r\n$-1\r\n", "*1\r\n$4097\r\n", "*1\r\n$3\r\nabcd\r\n", "*2\r\n$1\r\na\r\n"} {
+		_, err := readRESPCommand(bufio.NewReader(strings.NewReader(in)))
+		assert.Error(t, err, in)
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{"-ERR boom\r\n", respError("ERR boom")},
+		{":-42\r\n", int64(-42)},
+		{"$5\r\nhe\r\no\r\n", []byte("he\r\no")},
+		{"$0\r\n\r\n", []byte{}},
+		{"$-1\r\n", nil},
+		{"*-1\r\n", nil},
+		{"_\r\n", nil},
+		{"#t\r\n", true},
+		{",1.5\r\n", 1.5},
+		{"(12345678901234567890\r\n", "12345678901234567890"},
+		{"=7\r\ntxt:abc\r\n", []byte("abc")},
+		{"!8\r\nERR boom\r\n", respError("ERR boom")},
+		{"*2\r\n:1\r\n*1\r\n+a\r\n", []interface{}{int64(1), []interface{}{"a"}}},
+		{"%1\r\n+k\r\n:1\r\n", []interface{}{"k", int64(1)}},
+		{"~1\r\n:1\r\n", []interface{}{int64(1)}},
+	}
+	for _, tt := range tests {
+		v, err := readRESP(bufio.NewReader(strings.NewReader(tt.in)))
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, v, tt.in)
+	}
+
+	for _, in := range []string{"", "\r\n", "?\r\n", ":x\r\n", "$3\r\nabcd\r\n", "$3\r\nab", "*2\r\n:1\r\n", "$99999999999\r\n"} {
+		_, err := readRESP(bufio.NewReader(strings.NewReader(in)))
+		assert.Error(t, err, in)
+	}
+}
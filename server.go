@@ -0,0 +1,434 @@
+package lampstamp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The clock server speaks a line protocol. Every request is a line
+//
+//	GET key | INC key | TICK key ts | VTICK key ts | LEASE key min n |
+//	PING | QUIT
+//
+// answered by a line
+//
+//	OK ts | STALE current | ERR message
+//
+// Keys containing spaces, quotes or control characters are sent as Go
+// quoted strings. Requests can be pipelined, and "BATCH n" followed by n
+// requests is answered with n responses in one flush.
+//
+// Requests starting with '*' are RESP commands instead, see resp.go.
+const (
+	OpGet             = "GET"
+	OpInc             = "INC"
+	OpTick            = "TICK"
+	OpValidateAndTick = "VTICK"
+	// OpLease requires a Clock that is a Leaser.
+	OpLease = "LEASE"
+
+	opBatch = "BATCH"
+	opPing  = "PING"
+	opQuit  = "QUIT"
+
+	replyOK    = "OK"
+	replyStale = "STALE"
+	replyErr   = "ERR"
+
+	// maxBatch bounds the number of requests of a BATCH.
+	maxBatch = 1 << 16
+)
+
+var (
+	ErrServerClosed = errors.New("server closed")
+	ErrProtocol     = errors.New("protocol error")
+)
+
+// Server serves a Clock over TCP.
+type Server struct {
+	Clock Clock
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// Serve accepts connections on l and answers their requests until the
+// server is closed, in which case it returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, nil) {
+		return ErrServerClosed
+	}
+	defer s.untrack(l, nil)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(nil, conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(nil, conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops the listeners, closes every connection and waits for their
+// requests to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) track(l net.Listener, c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[net.Conn]struct{})
+	}
+	if l != nil {
+		s.listeners[l] = struct{}{}
+	}
+	if c != nil {
+		s.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener, c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l != nil {
+		delete(s.listeners, l)
+	}
+	if c != nil {
+		delete(s.conns, c)
+		c.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	rw := &respWriter{w: w, proto: 2}
+	ctx := context.Background()
+
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+
+		var ok bool
+		if b[0] == '*' {
+			ok = s.handleRESP(ctx, r, rw)
+		} else {
+			ok = s.handleLine(ctx, r, w)
+		}
+		if !ok {
+			w.Flush()
+			return
+		}
+
+		// flush once the pipelined requests read so far are answered
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleLine reads and answers one request of the line protocol. It
+// returns false when the connection is to be closed.
+func (s *Server) handleLine(ctx context.Context, r *bufio.Reader, w *bufio.Writer) bool {
+	line, err := readLine(r)
+	if err != nil {
+		return false
+	}
+
+	op, _, _ := cutField(line)
+	switch strings.ToUpper(op) {
+	case opQuit:
+		w.WriteString(replyOK + "\r\n")
+		return false
+	case opBatch:
+		if err := s.batch(ctx, r, w, line); err != nil {
+			writeReply(w, Command{}, Result{Err: err})
+			return false
+		}
+	default:
+		s.handle(ctx, w, line)
+	}
+	return true
+}
+
+func (s *Server) batch(ctx context.Context, r *bufio.Reader, w *bufio.Writer, line string) error {
+	_, rest, _ := cutField(line)
+	n, err := strconv.Atoi(strings.TrimSpace(rest))
+	if err != nil || n < 0 || n > maxBatch {
+		return fmt.Errorf("%w: invalid batch size", ErrProtocol)
+	}
+
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		s.handle(ctx, w, line)
+	}
+	return nil
+}
+
+func (s *Server) handle(ctx context.Context, w *bufio.Writer, line string) {
+	cmd, res := s.exec(ctx, line)
+	writeReply(w, cmd, res)
+}
+
+func (s *Server) exec(ctx context.Context, line string) (Command, Result) {
+	cmd, err := parseCommand(line)
+	if err != nil {
+		return cmd, Result{Err: err}
+	}
+
+	var res Result
+	switch cmd.Op {
+	case OpGet:
+		res.Timestamp, res.Err = s.Clock.GetCtx(ctx, cmd.Key)
+	case OpInc:
+		res.Timestamp, res.Err = s.Clock.IncCtx(ctx, cmd.Key)
+	case OpTick:
+		res.Timestamp, res.Err = s.Clock.TickCtx(ctx, cmd.Key, cmd.Timestamp)
+	case OpValidateAndTick:
+		res.Timestamp, res.Err = s.Clock.ValidateAndTickCtx(ctx, cmd.Key, cmd.Timestamp)
+	case OpLease:
+		res.Timestamp, res.Err = s.lease(ctx, cmd.Key, cmd.Timestamp, cmd.N)
+	}
+	return cmd, res
+}
+
+func (s *Server) lease(ctx context.Context, key string, min, n int64) (int64, error) {
+	l, ok := s.Clock.(Leaser)
+	if !ok {
+		return defaultTimestamp, fmt.Errorf("%T does not lease counters", s.Clock)
+	}
+	return l.LeaseCtx(ctx, key, min, n)
+}
+
+// Command is a request of the clock server protocol.
+type Command struct {
+	Op        string
+	Key       string
+	Timestamp int64
+	// N is the number of counters of a LEASE, whose Timestamp is the
+	// minimum to lease above.
+	N int64
+}
+
+// Result is the answer to a Command. Err is a *StaleError when a
+// validate-and-tick was rejected.
+type Result struct {
+	Timestamp int64
+	Err       error
+}
+
+func (c Command) String() string {
+	switch c.Op {
+	case OpLease:
+		return c.Op + " " + quoteKey(c.Key) + " " + strconv.FormatInt(c.Timestamp, 10) + " " + strconv.FormatInt(c.N, 10)
+	case OpTick, OpValidateAndTick:
+		return c.Op + " " + quoteKey(c.Key) + " " + strconv.FormatInt(c.Timestamp, 10)
+	case OpGet, OpInc:
+		return c.Op + " " + quoteKey(c.Key)
+	}
+	return c.Op
+}
+
+func parseCommand(line string) (Command, error) {
+	op, rest, _ := cutField(line)
+	cmd := Command{Op: strings.ToUpper(op)}
+
+	switch cmd.Op {
+	case opPing:
+		return cmd, nil
+	case OpGet, OpInc, OpTick, OpValidateAndTick, OpLease:
+	default:
+		return cmd, fmt.Errorf("%w: unknown command %q", ErrProtocol, op)
+	}
+
+	key, rest, err := unquoteKey(rest)
+	if err != nil {
+		return cmd, err
+	}
+	cmd.Key = key
+
+	rest = strings.TrimSpace(rest)
+	if cmd.Op == OpGet || cmd.Op == OpInc {
+		if rest != "" {
+			return cmd, fmt.Errorf("%w: unexpected %q", ErrProtocol, rest)
+		}
+		return cmd, nil
+	}
+	if cmd.Op == OpLease {
+		var n string
+		rest, n, _ = strings.Cut(rest, " ")
+		if cmd.N, err = strconv.ParseInt(n, 10, 64); err != nil || cmd.N < 1 {
+			return cmd, fmt.Errorf("%w: invalid lease size %q", ErrProtocol, n)
+		}
+	}
+	if cmd.Timestamp, err = strconv.ParseInt(rest, 10, 64); err != nil {
+		return cmd, fmt.Errorf("%w: invalid timestamp %q", ErrProtocol, rest)
+	}
+	return cmd, nil
+}
+
+func writeReply(w *bufio.Writer, cmd Command, res Result) {
+	var stale *StaleError
+	switch {
+	case cmd.Op == opPing && res.Err == nil:
+		w.WriteString(replyOK + "\r\n")
+	case errors.As(res.Err, &stale):
+		w.WriteString(replyStale + " " + strconv.FormatInt(stale.Current, 10) + "\r\n")
+	case res.Err != nil:
+		w.WriteString(replyErr + " " + strings.NewReplacer("\r", " ", "\n", " ").Replace(res.Err.Error()) + "\r\n")
+	default:
+		w.WriteString(replyOK + " " + strconv.FormatInt(res.Timestamp, 10) + "\r\n")
+	}
+}
+
+// parseReply decodes the reply to cmd.
+func parseReply(cmd Command, line string) Result {
+	kind, rest, _ := cutField(line)
+	rest = strings.TrimSpace(rest)
+
+	switch kind {
+	case replyOK:
+		if rest == "" {
+			return Result{}
+		}
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return Result{Err: fmt.Errorf("%w: invalid reply %q", ErrProtocol, line)}
+		}
+		return Result{Timestamp: ts}
+	case replyStale:
+		current, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return Result{Err: fmt.Errorf("%w: invalid reply %q", ErrProtocol, line)}
+		}
+		return Result{Timestamp: current, Err: &StaleError{Key: cmd.Key, Request: cmd.Timestamp, Current: current}}
+	case replyErr:
+		return Result{Err: &ServerError{Message: rest}}
+	}
+	return Result{Err: fmt.Errorf("%w: invalid reply %q", ErrProtocol, line)}
+}
+
+// ServerError is an error reported by the clock server, or by Redis for
+// a RedisClock.
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server: " + e.Message
+}
+
+// maxLine bounds the length of a request or reply line.
+const maxLine = 64 << 10
+
+func readLine(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		sb.Write(chunk)
+		if sb.Len() > maxLine {
+			return "", fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		if !isPrefix {
+			return sb.String(), nil
+		}
+	}
+}
+
+func cutField(s string) (field, rest string, ok bool) {
+	s = strings.TrimLeft(s, " ")
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+func quoteKey(key string) string {
+	if key == "" || strings.IndexFunc(key, func(r rune) bool {
+		return r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(key)
+	}
+	return key
+}
+
+func unquoteKey(s string) (key, rest string, err error) {
+	s = strings.TrimLeft(s, " ")
+	if strings.HasPrefix(s, `"`) {
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: invalid key %q", ErrProtocol, s)
+		}
+		key, _ = strconv.Unquote(quoted)
+		return key, s[len(quoted):], nil
+	}
+
+	key, rest, _ = cutField(s)
+	if key == "" {
+		return "", "", fmt.Errorf("%w: missing key", ErrProtocol)
+	}
+	return key, rest, nil
+}
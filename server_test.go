@@ -0,0 +1,163 @@
+package lampstamp
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startTestServer(t *testing.T, clock Clock) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &Server{Clock: clock}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+	t.Cleanup(func() {
+		srv.Close()
+		assert.ErrorIs(t, <-done, ErrServerClosed)
+	})
+	return l.Addr().String()
+}
+
+// exchange writes the request lines at once and reads n reply lines.
+func exchange(t *testing.T, conn net.Conn, r *bufio.Reader, n int, lines ...string) []string {
+	t.Helper()
+
+	_, err := conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	require.NoError(t, err)
+
+	replies := make([]string, n)
+	for i := range replies {
+		replies[i], err = readLine(r)
+		require.NoError(t, err)
+	}
+	return replies
+}
+
+func TestServer(t *testing.T) {
+	addr := startTestServer(t, NewLampstamp())
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// pipelined
+	assert.Equal(t, []string{"OK", "OK 0", "OK 1", "OK 6", "STALE 6", "OK 7", "OK 7"},
+		exchange(t, conn, r, 7,
+			"PING",
+			"GET msg-id-1",
+			"INC msg-id-1",
+			"TICK msg-id-1 5",
+			"VTICK msg-id-1 3",
+			"vtick msg-id-1 6",
+			"GET msg-id-1",
+		))
+
+	assert.Equal(t, []string{"OK 1", "OK 5", "OK 1"},
+		exchange(t, conn, r, 3,
+			"BATCH 3",
+			`INC "key with spaces"`,
+			`TICK "key with spaces" 4`,
+			`INC ""`,
+		))
+
+	assert.Equal(t, int64(0), NewLampstamp().Get("key with spaces"))
+
+	assert.Equal(t, []string{"OK 17"}, exchange(t, conn, r, 1, "LEASE leased 7 10"))
+
+	replies := exchange(t, conn, r, 7,
+		"FROB msg-id-1",
+		"GET",
+		"TICK msg-id-1",
+		"TICK msg-id-1 x",
+		"INC msg-id-1 2",
+		"LEASE msg-id-1 1",
+		"LEASE msg-id-1 1 0",
+	)
+	for _, reply := range replies {
+		assert.True(t, strings.HasPrefix(reply, "ERR "), reply)
+	}
+
+	// the connection is still usable after errors
+	assert.Equal(t, []string{"OK 8"}, exchange(t, conn, r, 1, "INC msg-id-1"))
+
+	assert.Equal(t, []string{"OK"}, exchange(t, conn, r, 1, "QUIT"))
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+}
+
+func TestServerLeaseUnsupported(t *testing.T) {
+	addr := startTestServer(t, NewHybridClock(0))
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	reply := exchange(t, conn, r, 1, "LEASE msg-id-1 0 10")
+	assert.True(t, strings.HasPrefix(reply[0], "ERR "), reply[0])
+}
+
+func TestServerInvalidBatch(t *testing.T) {
+	addr := startTestServer(t, NewLampstamp())
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	reply := exchange(t, conn, r, 1, "BATCH -1")
+	assert.True(t, strings.HasPrefix(reply[0], "ERR "), reply[0])
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+}
+
+func TestServerClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &Server{Clock: NewLampstamp()}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	assert.Equal(t, []string{"OK 1"}, exchange(t, conn, r, 1, "INC msg-id-1"))
+
+	require.NoError(t, srv.Close())
+	assert.ErrorIs(t, <-done, ErrServerClosed)
+
+	// open connections are closed as well
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+
+	assert.ErrorIs(t, srv.Serve(l), ErrServerClosed)
+}
+
+func TestCommandString(t *testing.T) {
+	tests := []struct {
+		cmd  Command
+		want string
+	}{
+		{Command{Op: OpGet, Key: "msg-id-1"}, "GET msg-id-1"},
+		{Command{Op: OpInc, Key: "a b"}, `INC "a b"`},
+		{Command{Op: OpTick, Key: `"q"`, Timestamp: 3}, `TICK "\"q\"" 3`},
+		{Command{Op: OpValidateAndTick, Key: "k\n", Timestamp: -1}, `VTICK "k\n" -1`},
+		{Command{Op: OpGet}, `GET ""`},
+		{Command{Op: OpLease, Key: "k", Timestamp: 7, N: 100}, "LEASE k 7 100"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.cmd.String())
+
+		cmd, err := parseCommand(tt.want)
+		require.NoError(t, err)
+		assert.Equal(t, tt.cmd, cmd)
+	}
+}
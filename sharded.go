@@ -0,0 +1,74 @@
+package lampstamp
+
+// ShardedLampstamp spreads keys over independent Lampstamps, each with its
+// own lock and its own slice of the total capacity, so that ticks on
+// different keys rarely contend.
+type ShardedLampstamp struct {
+	shards []*Lampstamp
+}
+
+func NewShardedLampstamp(shards int, size int64) *ShardedLampstamp {
+	return NewShardedLampstampEvictor(shards, size, func(size int64) Evictor {
+		return NewFIFOEvictor(size)
+	})
+}
+
+// NewShardedLampstampEvictor is NewShardedLampstamp with the evictor of each
+// shard made by newEvictor for its slice of size.
+func NewShardedLampstampEvictor(shards int, size int64, newEvictor func(size int64) Evictor) *ShardedLampstamp {
+	if shards < 1 {
+		shards = 1
+	}
+
+	shardSize := size / int64(shards)
+	if shardSize < 2 {
+		shardSize = 2
+	}
+
+	s := &ShardedLampstamp{
+		shards: make([]*Lampstamp, shards),
+	}
+	for i := range s.shards {
+		s.shards[i] = NewLampstamp(WithEvictor(newEvictor(shardSize)))
+	}
+	return s
+}
+
+func (s *ShardedLampstamp) Get(key string) int64 {
+	return s.shard(key).Get(key)
+}
+
+func (s *ShardedLampstamp) Inc(key string) int64 {
+	return s.shard(key).Inc(key)
+}
+
+func (s *ShardedLampstamp) Tick(key string, requestTimestamp int64) int64 {
+	return s.shard(key).Tick(key, requestTimestamp)
+}
+
+func (s *ShardedLampstamp) ValidateAndTick(key string, requestTimestamp int64) (int64, error) {
+	return s.shard(key).ValidateAndTick(key, requestTimestamp)
+}
+
+func (s *ShardedLampstamp) Lease(key string, min, n int64) int64 {
+	return s.shard(key).Lease(key, min, n)
+}
+
+func (s *ShardedLampstamp) shard(key string) *Lampstamp {
+	return s.shards[fnv32a(key)%uint32(len(s.shards))]
+}
+
+// fnv32a is FNV-1a without the allocation of hash/fnv.
+func fnv32a(key string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	h := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= prime32
+	}
+	return h
+}
@@ -0,0 +1,114 @@
+package lampstamp
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedLampstamp(t *testing.T) {
+	lt := NewShardedLampstamp(4, 64)
+	assert.Len(t, lt.shards, 4)
+
+	assert.EqualValues(t, 1, lt.Inc("a"))
+	assert.EqualValues(t, 11, lt.Tick("a", 10))
+	assert.EqualValues(t, 11, lt.Get("a"))
+	assert.EqualValues(t, 0, lt.Get("b"))
+}
+
+func TestShardedLampstampEvictor(t *testing.T) {
+	lt := NewShardedLampstampEvictor(1, 2, func(size int64) Evictor {
+		return NewLRUEvictor(int(size))
+	})
+
+	lt.Inc("a")
+	lt.Tick("b", 10)
+	lt.Inc("a")
+	lt.Inc("c")
+
+	// "b" was the least recently used key and has been evicted, where a
+	// FIFO evictor would have evicted "a"
+	_, ok := lt.shards[0].lookup("a")
+	assert.True(t, ok)
+	_, ok = lt.shards[0].lookup("b")
+	assert.False(t, ok)
+	assert.EqualValues(t, 11, lt.shards[0].Floor())
+}
+
+func TestShardedLampstampConcurrent(t *testing.T) {
+	lt := NewShardedLampstamp(8, 1024)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				lt.Inc(strconv.Itoa(i % 10))
+			}
+		}()
+	}
+	wg.Wait()
+
+	var total int64
+	for i := 0; i < 10; i++ {
+		total += lt.Get(strconv.Itoa(i))
+	}
+	assert.EqualValues(t, 8000, total)
+}
+
+func TestShardedLampstampMonotonicAcrossEviction(t *testing.T) {
+	lt := NewShardedLampstamp(4, 16)
+	last := make(map[string]int64)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 100; i++ {
+			key := strconv.Itoa(i)
+			val := lt.Tick(key, 1)
+			assert.Greater(t, val, last[key])
+			last[key] = val
+		}
+	}
+}
+
+func benchmarkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = uuid.New().String()
+	}
+	return keys
+}
+
+func BenchmarkLampstampParallelKeys(b *testing.B) {
+	keys := benchmarkKeys(1 << 16)
+	lt := NewLampstampSize(102400)
+	b.RunParallel(func(pb *testing.PB) {
+		// goroutines walking the keys in lockstep would all hit the same
+		// shard at once
+		i := rand.Intn(len(keys))
+		for pb.Next() {
+			lt.Tick(keys[i&(len(keys)-1)], 2)
+			i++
+		}
+	})
+}
+
+func BenchmarkShardedLampstampParallel(b *testing.B) {
+	keys := benchmarkKeys(1 << 16)
+	for _, shards := range []int{1, 2, 4, 8, 16, 32, 64} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			lt := NewShardedLampstamp(shards, 102400)
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Intn(len(keys))
+				for pb.Next() {
+					lt.Tick(keys[i&(len(keys)-1)], 2)
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package lampstamp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"reflect"
+)
+
+// Snapshot layout, all integers are varints unless noted:
+//
+//	magic "LMPS" | version byte | floor | count | count * (len(key) | key | counter) | crc32 (4 bytes, big endian)
+//
+// Keys are written in eviction order so that a restored clock evicts them
+// in the same order. Keys other than strings are encoded by marshalKey.
+const (
+	snapshotMagic   = "LMPS"
+	snapshotVersion = 1
+)
+
+var (
+	ErrUnsupportedKey   = errors.New("unsupported key type")
+	ErrSnapshotFormat   = errors.New("invalid snapshot format")
+	ErrSnapshotVersion  = errors.New("unsupported snapshot version")
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// Snapshot writes a consistent copy of the clock to w.
+func (ts *KeyedLampstamp[K]) Snapshot(w io.Writer) error {
+	var buf bytes.Buffer
+
+	ts.l.RLock()
+	keys := ts.e.Keys()
+	buf.WriteString(snapshotMagic)
+	buf.WriteByte(snapshotVersion)
+	writeVarint(&buf, ts.floor)
+	writeUvarint(&buf, uint64(len(keys)))
+	for _, key := range keys {
+		data, err := marshalKey(key)
+		if err != nil {
+			ts.l.RUnlock()
+			return err
+		}
+		writeString(&buf, string(data))
+		writeVarint(&buf, ts.m[key])
+	}
+	ts.l.RUnlock()
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(sum[:])
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Restore replaces the state of the clock with a snapshot read from r.
+// Keys beyond the capacity of the evictor are evicted as they are restored,
+// raising the floor like ordinary evictions do. A NodeClock is raised to
+// the restored counters.
+func (ts *KeyedLampstamp[K]) Restore(r io.Reader) error {
+	br := bufio.NewReader(r)
+	cr := &crcReader{r: br, h: crc32.NewIEEE()}
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(cr, magic); err != nil || string(magic) != snapshotMagic {
+		return ErrSnapshotFormat
+	}
+	version, err := cr.ReadByte()
+	if err != nil {
+		return ErrSnapshotFormat
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("%w: %d", ErrSnapshotVersion, version)
+	}
+
+	floor, err := binary.ReadVarint(cr)
+	if err != nil {
+		return ErrSnapshotFormat
+	}
+	count, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return ErrSnapshotFormat
+	}
+
+	keys := make([]K, 0)
+	vals := make(map[K]int64)
+	for i := uint64(0); i < count; i++ {
+		data, err := readString(cr)
+		if err != nil {
+			return ErrSnapshotFormat
+		}
+		key, err := unmarshalKey[K]([]byte(data))
+		if err != nil {
+			return err
+		}
+		val, err := binary.ReadVarint(cr)
+		if err != nil {
+			return ErrSnapshotFormat
+		}
+		if _, ok := vals[key]; ok {
+			// a second entry would be admitted to the evictor twice
+			return fmt.Errorf("%w: key %s listed twice", ErrSnapshotFormat, keyString(key))
+		}
+		keys = append(keys, key)
+		vals[key] = val
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return ErrSnapshotFormat
+	}
+	if binary.BigEndian.Uint32(sum[:]) != cr.h.Sum32() {
+		return ErrSnapshotChecksum
+	}
+
+	ts.l.Lock()
+	defer ts.l.Unlock()
+
+	ts.m = make(map[K]int64, len(keys))
+	ts.e.Reset()
+	ts.floor = floor
+	ts.unseeded = nil
+	highest := floor
+	for _, key := range keys {
+		ts.m[key] = vals[key]
+		ts.touch(key, false)
+		highest = max(highest, vals[key])
+	}
+	if ts.node != nil {
+		ts.node.observe(highest)
+	}
+
+	return nil
+}
+
+// marshalKey encodes keys that are strings, integers or implement
+// encoding.BinaryMarshaler, such as uuid.UUID.
+func marshalKey[K comparable](key K) ([]byte, error) {
+	switch k := interface{}(key).(type) {
+	case string:
+		return []byte(k), nil
+	case encoding.BinaryMarshaler:
+		return k.MarshalBinary()
+	}
+
+	var b [binary.MaxVarintLen64]byte
+	v := reflect.ValueOf(key)
+	switch v.Kind() {
+	case reflect.String:
+		return []byte(v.String()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return b[:binary.PutVarint(b[:], v.Int())], nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return b[:binary.PutUvarint(b[:], v.Uint())], nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+}
+
+func unmarshalKey[K comparable](data []byte) (K, error) {
+	var key K
+	switch k := interface{}(&key).(type) {
+	case *string:
+		*k = string(data)
+		return key, nil
+	case encoding.BinaryUnmarshaler:
+		if err := k.UnmarshalBinary(data); err != nil {
+			return key, ErrSnapshotFormat
+		}
+		return key, nil
+	}
+
+	v := reflect.ValueOf(&key).Elem()
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(data))
+		return key, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, n := binary.Varint(data)
+		if n != len(data) || v.OverflowInt(i) {
+			return key, ErrSnapshotFormat
+		}
+		v.SetInt(i)
+		return key, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, n := binary.Uvarint(data)
+		if n != len(data) || v.OverflowUint(u) {
+			return key, ErrSnapshotFormat
+		}
+		v.SetUint(u)
+		return key, nil
+	}
+	return key, fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+}
+
+// crcReader hashes everything read through it.
+type crcReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+// maxKeyLen bounds the allocation made for a key read from a corrupt
+// length prefix.
+const maxKeyLen = 1 << 20
+
+func readString(r io.ByteReader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > maxKeyLen {
+		return "", ErrSnapshotFormat
+	}
+	b := make([]byte, n)
+	for i := range b {
+		if b[i], err = r.ReadByte(); err != nil {
+			return "", err
+		}
+	}
+	return string(b), nil
+}
+
+func writeVarint(buf *bytes.Buffer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
@@ -0,0 +1,179 @@
+package lampstamp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	lt := NewLampstampSize(5)
+	for i := 0; i < 10; i++ {
+		lt.Tick(strconv.Itoa(i), int64(i))
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, lt.Snapshot(&buf))
+
+	restored := NewLampstampSize(5)
+	restored.Inc("stale")
+	assert.NoError(t, restored.Restore(bytes.NewReader(buf.Bytes())))
+
+	assert.Equal(t, lt.m, restored.m)
+	assert.Equal(t, lt.floor, restored.floor)
+	assert.Equal(t, lt.e.Keys(), restored.e.Keys())
+	assert.EqualValues(t, restored.Floor(), restored.Get("stale"))
+
+	// both evict the same key next
+	lt.Inc("new")
+	restored.Inc("new")
+	assert.Equal(t, lt.m, restored.m)
+	assert.Equal(t, lt.floor, restored.floor)
+}
+
+func TestSnapshotRestoreLRU(t *testing.T) {
+	lt := NewLampstamp(WithEvictor(NewLRUEvictor(3)))
+	lt.Inc("a")
+	lt.Inc("b")
+	lt.Inc("c")
+	lt.Inc("a")
+
+	var buf bytes.Buffer
+	assert.NoError(t, lt.Snapshot(&buf))
+
+	restored := NewLampstamp(WithEvictor(NewLRUEvictor(3)))
+	assert.NoError(t, restored.Restore(&buf))
+	assert.Equal(t, []string{"b", "c", "a"}, restored.e.Keys())
+}
+
+func TestRestoreIntoSmallerClock(t *testing.T) {
+	lt := NewLampstamp(WithEvictor(NewLRUEvictor(10)))
+	for i := 0; i < 10; i++ {
+		lt.Tick(strconv.Itoa(i), int64(i*10))
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, lt.Snapshot(&buf))
+
+	restored := NewLampstamp(WithEvictor(NewLRUEvictor(2)))
+	assert.NoError(t, restored.Restore(&buf))
+	assert.Len(t, restored.m, 2)
+	assert.EqualValues(t, 71, restored.Floor())
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		assert.GreaterOrEqual(t, restored.Get(key), lt.Get(key))
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	lt := NewLampstamp()
+	lt.Inc("a")
+	lt.Inc("b")
+
+	var buf bytes.Buffer
+	assert.NoError(t, lt.Snapshot(&buf))
+	data := buf.Bytes()
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-6] ^= 0xff
+	assert.ErrorIs(t, NewLampstamp().Restore(bytes.NewReader(corrupt)), ErrSnapshotChecksum)
+
+	badVersion := append([]byte(nil), data...)
+	badVersion[4] = 99
+	assert.ErrorIs(t, NewLampstamp().Restore(bytes.NewReader(badVersion)), ErrSnapshotVersion)
+
+	assert.ErrorIs(t, NewLampstamp().Restore(bytes.NewReader([]byte("nope"))), ErrSnapshotFormat)
+
+	for i := 0; i < len(data); i++ {
+		restored := NewLampstamp()
+		restored.Tick("keep", 7)
+		assert.Error(t, restored.Restore(bytes.NewReader(data[:i])))
+		// a failed restore leaves the clock untouched
+		assert.EqualValues(t, 8, restored.Get("keep"))
+	}
+}
+
+func TestRestoreDuplicateKey(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	buf.WriteByte(snapshotVersion)
+	writeVarint(&buf, 0)
+	writeUvarint(&buf, 2)
+	for _, val := range []int64{3, 5} {
+		writeString(&buf, "a")
+		writeVarint(&buf, val)
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(sum[:])
+
+	restored := NewLampstamp()
+	restored.Tick("keep", 7)
+	assert.ErrorIs(t, restored.Restore(&buf), ErrSnapshotFormat)
+	assert.EqualValues(t, 8, restored.Get("keep"))
+	assert.Equal(t, []string{"keep"}, restored.e.Keys())
+}
+
+func TestRestoreNodeClock(t *testing.T) {
+	lt := NewLampstamp(WithEvictor(NewLRUEvictor(1)))
+	lt.Tick("a", 10)
+	lt.Tick("b", 20)
+	lt.Tick("c", 5)
+
+	var buf bytes.Buffer
+	assert.NoError(t, lt.Snapshot(&buf))
+	data := buf.Bytes()
+
+	// the node clock passes the floor
+	node := NewNodeClock()
+	restored := NewLampstamp(WithNodeClock(node))
+	assert.NoError(t, restored.Restore(bytes.NewReader(data)))
+	assert.EqualValues(t, 21, node.Now())
+
+	// and the restored counters
+	lt.Tick("c", 30)
+	buf.Reset()
+	assert.NoError(t, lt.Snapshot(&buf))
+	assert.NoError(t, restored.Restore(&buf))
+	assert.EqualValues(t, 31, node.Now())
+	assert.Greater(t, restored.Inc("d"), int64(31))
+}
+
+type userID int32
+
+func TestSnapshotRestoreKeyed(t *testing.T) {
+	ints := NewKeyedLampstamp[userID]()
+	ints.Tick(-5, 10)
+	ints.Inc(1 << 30)
+
+	var buf bytes.Buffer
+	assert.NoError(t, ints.Snapshot(&buf))
+	restoredInts := NewKeyedLampstamp[userID]()
+	assert.NoError(t, restoredInts.Restore(&buf))
+	assert.Equal(t, ints.m, restoredInts.m)
+
+	// a snapshot of int32 keys does not fit int8 keys
+	buf.Reset()
+	assert.NoError(t, ints.Snapshot(&buf))
+	assert.ErrorIs(t, NewKeyedLampstamp[int8]().Restore(&buf), ErrSnapshotFormat)
+
+	id := uuid.New()
+	uuids := NewKeyedLampstamp[uuid.UUID]()
+	uuids.Tick(id, 3)
+
+	buf.Reset()
+	assert.NoError(t, uuids.Snapshot(&buf))
+	restoredUUIDs := NewKeyedLampstamp[uuid.UUID]()
+	assert.NoError(t, restoredUUIDs.Restore(&buf))
+	assert.EqualValues(t, 4, restoredUUIDs.Get(id))
+
+	type pair struct{ a, b int }
+	pairs := NewKeyedLampstamp[pair]()
+	pairs.Inc(pair{1, 2})
+	assert.ErrorIs(t, pairs.Snapshot(&buf), ErrUnsupportedKey)
+}
@@ -0,0 +1,155 @@
+package lampstamp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+type SQLStoreConfig struct {
+	// Table and the column names default to "lampstamp", "id", "value" and
+	// "version". They are put into queries as they are, so quote them if
+	// the database needs it.
+	Table         string
+	KeyColumn     string
+	ValueColumn   string
+	VersionColumn string
+
+	// Placeholder returns the placeholder of the nth argument of a query,
+	// counting from 1. It defaults to QuestionPlaceholder.
+	Placeholder func(n int) string
+}
+
+// QuestionPlaceholder is the placeholder style of MySQL and SQLite.
+func QuestionPlaceholder(n int) string {
+	return "?"
+}
+
+// DollarPlaceholder is the placeholder style of PostgreSQL.
+func DollarPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// SQLStore is a VersionedStore on a database/sql table whose key column is
+// unique. Writes run in a transaction that tries a guarded update first
+// and inserts if the key does not exist yet, which works on any database
+// without relying on a dialect's upsert.
+type SQLStore struct {
+	db *sql.DB
+
+	loadQuery    string
+	updateQuery  string
+	versionQuery string
+	insertQuery  string
+}
+
+var _ VersionedStore = (*SQLStore)(nil)
+
+// sqlStoreAttempts bounds the retries of a write that lost an insert race.
+const sqlStoreAttempts = 3
+
+func NewSQLStore(db *sql.DB, cfg SQLStoreConfig) *SQLStore {
+	if cfg.Table == "" {
+		cfg.Table = "lampstamp"
+	}
+	if cfg.KeyColumn == "" {
+		cfg.KeyColumn = "id"
+	}
+	if cfg.ValueColumn == "" {
+		cfg.ValueColumn = "value"
+	}
+	if cfg.VersionColumn == "" {
+		cfg.VersionColumn = "version"
+	}
+	p := cfg.Placeholder
+	if p == nil {
+		p = QuestionPlaceholder
+	}
+
+	return &SQLStore{
+		db: db,
+		loadQuery: fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = %s",
+			cfg.ValueColumn, cfg.VersionColumn, cfg.Table, cfg.KeyColumn, p(1)),
+		updateQuery: fmt.Sprintf("UPDATE %s SET %s = %s, %s = %s WHERE %s = %s AND %s < %s",
+			cfg.Table, cfg.ValueColumn, p(1), cfg.VersionColumn, p(2), cfg.KeyColumn, p(3), cfg.VersionColumn, p(4)),
+		versionQuery: fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s",
+			cfg.VersionColumn, cfg.Table, cfg.KeyColumn, p(1)),
+		insertQuery: fmt.Sprintf("INSERT INTO %s (%s, %s, %s) VALUES (%s, %s, %s)",
+			cfg.Table, cfg.KeyColumn, cfg.ValueColumn, cfg.VersionColumn, p(1), p(2), p(3)),
+	}
+}
+
+func (s *SQLStore) Load(ctx context.Context, key string) ([]byte, int64, error) {
+	var value []byte
+	var version int64
+	err := s.db.QueryRowContext(ctx, s.loadQuery, key).Scan(&value, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, defaultTimestamp, ErrNotFound
+	}
+	if err != nil {
+		return nil, defaultTimestamp, err
+	}
+	return value, version, nil
+}
+
+func (s *SQLStore) CompareAndStore(ctx context.Context, key string, value []byte, version int64) error {
+	var err error
+	for i := 0; i < sqlStoreAttempts; i++ {
+		var insertFailed bool
+		insertFailed, err = s.compareAndStore(ctx, key, value, version)
+		// an insert that failed because another writer inserted the key
+		// first is retried as an update
+		if !insertFailed || !s.exists(ctx, key) {
+			return err
+		}
+	}
+	return err
+}
+
+// compareAndStore makes one attempt at a write and reports whether it
+// failed at inserting the key. The transaction is rolled back on any error.
+func (s *SQLStore) compareAndStore(ctx context.Context, key string, value []byte, version int64) (insertFailed bool, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, s.updateQuery, value, version, key, version)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n > 0 {
+		return false, tx.Commit()
+	}
+
+	var stored int64
+	err = tx.QueryRowContext(ctx, s.versionQuery, key).Scan(&stored)
+	if err == nil {
+		return false, &VersionConflictError{Key: key, Version: version, Stored: stored}
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	if _, err = tx.ExecContext(ctx, s.insertQuery, key, value, version); err != nil {
+		return true, err
+	}
+	return false, tx.Commit()
+}
+
+// exists tells whether key is stored, which after a failed insert means
+// that a concurrent writer inserted it. It runs outside of the transaction
+// of the insert, which may be aborted.
+func (s *SQLStore) exists(ctx context.Context, key string) bool {
+	var stored int64
+	return s.db.QueryRowContext(ctx, s.versionQuery, key).Scan(&stored) == nil
+}
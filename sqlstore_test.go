@@ -0,0 +1,323 @@
+package lampstamp_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wonksing/lampstamp"
+	"github.com/wonksing/lampstamp/storetest"
+)
+
+// fakeDriver is an in-process database/sql driver that understands the
+// queries of SQLStore. Each DSN is a separate database whose transactions
+// run one at a time, and the DSN names the unique key column.
+type fakeDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeDB
+}
+
+var testDriver = &fakeDriver{dbs: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("lampstampfake", testDriver)
+}
+
+func (d *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	db, ok := d.dbs[dsn]
+	if !ok {
+		keyColumn := dsn[strings.LastIndexByte(dsn, '=')+1:]
+		db = &fakeDB{
+			lock:      make(chan struct{}, 1),
+			keyColumn: keyColumn,
+			tables:    make(map[string][]map[string]driver.Value),
+		}
+		d.dbs[dsn] = db
+	}
+	return &fakeConn{db: db}, nil
+}
+
+type fakeDB struct {
+	lock      chan struct{}
+	keyColumn string
+	tables    map[string][]map[string]driver.Value
+
+	// beforeInsert runs before an insert, as if from another connection
+	beforeInsert func(db *fakeDB)
+	statements   []string
+}
+
+type fakeConn struct {
+	db *fakeDB
+	tx *fakeTx
+}
+
+type fakeTx struct {
+	conn *fakeConn
+	undo []func()
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+type fakeResult int64
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.lock <- struct{}{}
+	c.tx = &fakeTx{conn: c}
+	return c.tx, nil
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.conn.tx = nil
+	<-tx.conn.db.lock
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	return tx.Commit()
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	rows, err := s.run(args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult(len(rows.values)), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.run(args)
+}
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return 0, errors.New("not supported")
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return int64(r), nil
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var (
+	updateRe      = regexp.MustCompile(`^UPDATE (\w+) SET (\w+) = \S+, (\w+) = \S+ WHERE (\w+) = \S+ AND (\w+) < \S+$`)
+	selectRe      = regexp.MustCompile(`^SELECT ([\w, ]+) FROM (\w+) WHERE (\w+) = \S+$`)
+	insertRe      = regexp.MustCompile(`^INSERT INTO (\w+) \((\w+), (\w+), (\w+)\) VALUES \(\S+, \S+, \S+\)$`)
+	errDuplicated = errors.New("duplicate key")
+)
+
+// run executes a statement. Outside of a transaction it takes the
+// database lock for the duration of the statement.
+func (s *fakeStmt) run(args []driver.Value) (*fakeRows, error) {
+	db := s.conn.db
+	if s.conn.tx == nil {
+		db.lock <- struct{}{}
+		defer func() { <-db.lock }()
+	}
+	db.statements = append(db.statements, s.query)
+
+	if m := updateRe.FindStringSubmatch(s.query); m != nil {
+		table, valueCol, versionCol, keyCol, guardCol := m[1], m[2], m[3], m[4], m[5]
+		if keyCol != db.keyColumn || versionCol != guardCol {
+			return nil, fmt.Errorf("unexpected update: %s", s.query)
+		}
+		rows := &fakeRows{}
+		for _, row := range db.tables[table] {
+			if row[keyCol] == args[2] && row[guardCol].(int64) < args[3].(int64) {
+				prevValue, prevVersion := row[valueCol], row[versionCol]
+				row := row
+				s.conn.tx.undo = append(s.conn.tx.undo, func() {
+					row[valueCol], row[versionCol] = prevValue, prevVersion
+				})
+				row[valueCol], row[versionCol] = cloneValue(args[0]), args[1]
+				rows.values = append(rows.values, nil)
+			}
+		}
+		return rows, nil
+	}
+
+	if m := selectRe.FindStringSubmatch(s.query); m != nil {
+		columns, table, keyCol := strings.Split(m[1], ", "), m[2], m[3]
+		rows := &fakeRows{columns: columns}
+		for _, row := range db.tables[table] {
+			if row[keyCol] != args[0] {
+				continue
+			}
+			var values []driver.Value
+			for _, col := range columns {
+				v, ok := row[col]
+				if !ok {
+					return nil, fmt.Errorf("no column %s", col)
+				}
+				values = append(values, v)
+			}
+			rows.values = append(rows.values, values)
+		}
+		return rows, nil
+	}
+
+	if m := insertRe.FindStringSubmatch(s.query); m != nil {
+		if db.beforeInsert != nil {
+			db.beforeInsert(db)
+		}
+		table := m[1]
+		row := map[string]driver.Value{m[2]: args[0], m[3]: cloneValue(args[1]), m[4]: args[2]}
+		for _, existing := range db.tables[table] {
+			if existing[db.keyColumn] == row[db.keyColumn] {
+				return nil, errDuplicated
+			}
+		}
+		n := len(db.tables[table])
+		s.conn.tx.undo = append(s.conn.tx.undo, func() {
+			db.tables[table] = db.tables[table][:n]
+		})
+		db.tables[table] = append(db.tables[table], row)
+		return &fakeRows{values: [][]driver.Value{nil}}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected query: %s", s.query)
+}
+
+// cloneValue copies byte slices, which database/sql hands to drivers
+// without copying.
+func cloneValue(v driver.Value) driver.Value {
+	if b, ok := v.([]byte); ok {
+		return append([]byte(nil), b...)
+	}
+	return v
+}
+
+func openFakeDB(t *testing.T, keyColumn string) (*sql.DB, *fakeDB) {
+	dsn := t.Name() + ";key=" + keyColumn
+	db, err := sql.Open("lampstampfake", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db.Close()
+		// a rerun of the test starts from an empty database
+		testDriver.mu.Lock()
+		delete(testDriver.dbs, dsn)
+		testDriver.mu.Unlock()
+	})
+
+	require.NoError(t, db.Ping())
+	testDriver.mu.Lock()
+	defer testDriver.mu.Unlock()
+	return db, testDriver.dbs[dsn]
+}
+
+func TestSQLStore(t *testing.T) {
+	storetest.TestVersionedStore(t, func(t *testing.T) lampstamp.VersionedStore {
+		db, _ := openFakeDB(t, "id")
+		return lampstamp.NewSQLStore(db, lampstamp.SQLStoreConfig{})
+	})
+}
+
+func TestSQLStoreConfig(t *testing.T) {
+	db, fake := openFakeDB(t, "doc_id")
+	s := lampstamp.NewSQLStore(db, lampstamp.SQLStoreConfig{
+		Table:         "documents",
+		KeyColumn:     "doc_id",
+		ValueColumn:   "body",
+		VersionColumn: "rev",
+		Placeholder:   lampstamp.DollarPlaceholder,
+	})
+	ctx := context.Background()
+
+	require.NoError(t, s.CompareAndStore(ctx, "msg-id-1", []byte("foo"), 1))
+	require.NoError(t, s.CompareAndStore(ctx, "msg-id-1", []byte("bar"), 2))
+	assert.Equal(t, []string{
+		"UPDATE documents SET body = $1, rev = $2 WHERE doc_id = $3 AND rev < $4",
+		"SELECT rev FROM documents WHERE doc_id = $1",
+		"INSERT INTO documents (doc_id, body, rev) VALUES ($1, $2, $3)",
+		"UPDATE documents SET body = $1, rev = $2 WHERE doc_id = $3 AND rev < $4",
+	}, fake.statements)
+
+	value, version, err := s.Load(ctx, "msg-id-1")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", string(value))
+	assert.EqualValues(t, 2, version)
+}
+
+func TestSQLStoreInsertRace(t *testing.T) {
+	db, fake := openFakeDB(t, "id")
+	s := lampstamp.NewSQLStore(db, lampstamp.SQLStoreConfig{})
+
+	// another writer inserts the key between our check and our insert
+	fake.beforeInsert = func(db *fakeDB) {
+		db.beforeInsert = nil
+		db.tables["lampstamp"] = append(db.tables["lampstamp"], map[string]driver.Value{
+			"id": "msg-id-1", "value": []byte("bar"), "version": int64(5),
+		})
+	}
+
+	err := s.CompareAndStore(context.Background(), "msg-id-1", []byte("foo"), 3)
+	var conflict *lampstamp.VersionConflictError
+	require.True(t, errors.As(err, &conflict))
+	assert.EqualValues(t, 5, conflict.Stored)
+
+	fake.beforeInsert = func(db *fakeDB) {
+		db.beforeInsert = nil
+		db.tables["lampstamp"] = append(db.tables["lampstamp"], map[string]driver.Value{
+			"id": "msg-id-2", "value": []byte("bar"), "version": int64(1),
+		})
+	}
+	require.NoError(t, s.CompareAndStore(context.Background(), "msg-id-2", []byte("foo"), 3))
+	value, version, err := s.Load(context.Background(), "msg-id-2")
+	require.NoError(t, err)
+	assert.Equal(t, "foo", string(value))
+	assert.EqualValues(t, 3, version)
+}
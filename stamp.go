@@ -0,0 +1,105 @@
+package lampstamp
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Stamp is a Lamport timestamp made totally ordered by the ID of the node
+// that issued it. Stamps compare by Counter first and by Node second, so
+// when two nodes issue the same counter for the same key the write of the
+// node whose ID sorts last wins.
+type Stamp struct {
+	Counter int64
+	Node    string
+}
+
+var ErrInvalidStamp = errors.New("invalid stamp")
+
+// Compare returns -1, 0 or +1 depending on whether s sorts before, equal
+// to or after other.
+func (s Stamp) Compare(other Stamp) int {
+	switch {
+	case s.Counter < other.Counter:
+		return -1
+	case s.Counter > other.Counter:
+		return 1
+	}
+	return strings.Compare(s.Node, other.Node)
+}
+
+func (s Stamp) Less(other Stamp) bool {
+	return s.Compare(other) < 0
+}
+
+func (s Stamp) String() string {
+	return strconv.FormatInt(s.Counter, 10) + "@" + s.Node
+}
+
+// MarshalText encodes the stamp as "counter@node".
+func (s Stamp) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Stamp) UnmarshalText(text []byte) error {
+	i := strings.IndexByte(string(text), '@')
+	if i < 0 {
+		return ErrInvalidStamp
+	}
+	counter, err := strconv.ParseInt(string(text[:i]), 10, 64)
+	if err != nil {
+		return ErrInvalidStamp
+	}
+
+	s.Counter = counter
+	s.Node = string(text[i+1:])
+	return nil
+}
+
+// MarshalBinary encodes the stamp as a varint counter followed by the node
+// ID.
+func (s Stamp) MarshalBinary() ([]byte, error) {
+	b := make([]byte, binary.MaxVarintLen64+len(s.Node))
+	n := binary.PutVarint(b, s.Counter)
+	n += copy(b[n:], s.Node)
+	return b[:n], nil
+}
+
+func (s *Stamp) UnmarshalBinary(data []byte) error {
+	counter, n := binary.Varint(data)
+	if n <= 0 {
+		return ErrInvalidStamp
+	}
+
+	s.Counter = counter
+	s.Node = string(data[n:])
+	return nil
+}
+
+func (ts *KeyedLampstamp[K]) NodeID() string {
+	return ts.nodeID
+}
+
+// GetStamp is Get returning a Stamp of this node.
+func (ts *KeyedLampstamp[K]) GetStamp(key K) Stamp {
+	return Stamp{Counter: ts.Get(key), Node: ts.nodeID}
+}
+
+// IncStamp is Inc returning a Stamp of this node.
+func (ts *KeyedLampstamp[K]) IncStamp(key K) Stamp {
+	return Stamp{Counter: ts.Inc(key), Node: ts.nodeID}
+}
+
+// TickStamp is Tick taking the counter of a remote Stamp.
+func (ts *KeyedLampstamp[K]) TickStamp(key K, remote Stamp) Stamp {
+	return Stamp{Counter: ts.Tick(key, remote.Counter), Node: ts.nodeID}
+}
+
+// ValidateAndTickStamp is ValidateAndTick taking the counter of a remote
+// Stamp.
+func (ts *KeyedLampstamp[K]) ValidateAndTickStamp(key K, remote Stamp) (Stamp, error) {
+	val, err := ts.ValidateAndTick(key, remote.Counter)
+	return Stamp{Counter: val, Node: ts.nodeID}, err
+}
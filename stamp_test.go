@@ -0,0 +1,80 @@
+package lampstamp
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStampCompare(t *testing.T) {
+	stamps := []Stamp{
+		{2, "svr-1"},
+		{1, "svr-2"},
+		{2, "svr-2"},
+		{1, "svr-1"},
+		{3, ""},
+	}
+	sort.Slice(stamps, func(i, j int) bool {
+		return stamps[i].Less(stamps[j])
+	})
+	assert.Equal(t, []Stamp{{1, "svr-1"}, {1, "svr-2"}, {2, "svr-1"}, {2, "svr-2"}, {3, ""}}, stamps)
+
+	assert.Equal(t, 0, Stamp{1, "a"}.Compare(Stamp{1, "a"}))
+	assert.Equal(t, 1, Stamp{1, "b"}.Compare(Stamp{1, "a"}))
+	assert.Equal(t, -1, Stamp{1, "b"}.Compare(Stamp{2, "a"}))
+}
+
+func TestStampText(t *testing.T) {
+	s := Stamp{42, "svr@1"}
+	text, err := s.MarshalText()
+	assert.NoError(t, err)
+	assert.Equal(t, "42@svr@1", string(text))
+
+	var decoded Stamp
+	assert.NoError(t, decoded.UnmarshalText(text))
+	assert.Equal(t, s, decoded)
+
+	assert.ErrorIs(t, decoded.UnmarshalText([]byte("42")), ErrInvalidStamp)
+	assert.ErrorIs(t, decoded.UnmarshalText([]byte("x@svr")), ErrInvalidStamp)
+
+	data, err := json.Marshal(map[string]Stamp{"version": s})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"version": "42@svr@1"}`, string(data))
+}
+
+func TestStampBinary(t *testing.T) {
+	for _, s := range []Stamp{{0, ""}, {-1, "a"}, {1 << 40, "svr-1"}} {
+		data, err := s.MarshalBinary()
+		assert.NoError(t, err)
+
+		var decoded Stamp
+		assert.NoError(t, decoded.UnmarshalBinary(data))
+		assert.Equal(t, s, decoded)
+	}
+
+	var decoded Stamp
+	assert.ErrorIs(t, decoded.UnmarshalBinary(nil), ErrInvalidStamp)
+}
+
+func TestLampstampStamps(t *testing.T) {
+	svr1 := NewLampstamp(WithNodeID("svr-1"))
+	svr2 := NewLampstamp(WithNodeID("svr-2"))
+
+	// both servers issue the same counter for the same message, svr-2 wins
+	foo := svr1.TickStamp("msg-id-1", Stamp{1, "client-1"})
+	bar := svr2.TickStamp("msg-id-1", Stamp{1, "client-2"})
+	assert.Equal(t, Stamp{2, "svr-1"}, foo)
+	assert.Equal(t, Stamp{2, "svr-2"}, bar)
+	assert.True(t, foo.Less(bar))
+
+	assert.Equal(t, Stamp{3, "svr-1"}, svr1.IncStamp("msg-id-1"))
+	assert.Equal(t, Stamp{3, "svr-1"}, svr1.GetStamp("msg-id-1"))
+
+	_, err := svr1.ValidateAndTickStamp("msg-id-1", bar)
+	assert.ErrorIs(t, err, ErrStale)
+	s, err := svr1.ValidateAndTickStamp("msg-id-1", Stamp{3, "svr-2"})
+	assert.NoError(t, err)
+	assert.Equal(t, Stamp{4, "svr-1"}, s)
+}
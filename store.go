@@ -0,0 +1,93 @@
+package lampstamp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// VersionedStore stores values under versions that only go up, which is
+// how the storage check of the README keeps causally older writes from
+// overwriting newer ones.
+type VersionedStore interface {
+	// Load returns the value and version stored under key, or ErrNotFound.
+	Load(ctx context.Context, key string) (value []byte, version int64, err error)
+	// CompareAndStore stores value under key if version is higher than the
+	// stored one, and returns a *VersionConflictError otherwise. The check
+	// and the write are atomic.
+	CompareAndStore(ctx context.Context, key string, value []byte, version int64) error
+}
+
+var (
+	ErrNotFound        = errors.New("key not found")
+	ErrVersionConflict = errors.New("version conflict")
+)
+
+// VersionConflictError is returned when a write is not newer than what is
+// stored. It matches ErrVersionConflict with errors.Is.
+type VersionConflictError struct {
+	Key     string
+	Version int64
+	Stored  int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict for %s: %d is not higher than stored %d", e.Key, e.Version, e.Stored)
+}
+
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+// MemoryStore is an in-memory VersionedStore.
+type MemoryStore struct {
+	m map[string]memoryEntry
+	l sync.RWMutex
+}
+
+type memoryEntry struct {
+	value   []byte
+	version int64
+}
+
+var _ VersionedStore = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		m: make(map[string]memoryEntry),
+	}
+}
+
+func (s *MemoryStore) Load(ctx context.Context, key string) ([]byte, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, defaultTimestamp, err
+	}
+
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	entry, ok := s.m[key]
+	if !ok {
+		return nil, defaultTimestamp, ErrNotFound
+	}
+	return append([]byte(nil), entry.value...), entry.version, nil
+}
+
+func (s *MemoryStore) CompareAndStore(ctx context.Context, key string, value []byte, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if entry, ok := s.m[key]; ok && entry.version >= version {
+		return &VersionConflictError{Key: key, Version: version, Stored: entry.version}
+	}
+	s.m[key] = memoryEntry{
+		value:   append([]byte(nil), value...),
+		version: version,
+	}
+	return nil
+}
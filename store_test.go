@@ -0,0 +1,14 @@
+package lampstamp_test
+
+import (
+	"testing"
+
+	"github.com/wonksing/lampstamp"
+	"github.com/wonksing/lampstamp/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.TestVersionedStore(t, func(t *testing.T) lampstamp.VersionedStore {
+		return lampstamp.NewMemoryStore()
+	})
+}
@@ -0,0 +1,162 @@
+// Package storetest checks VersionedStore implementations.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/wonksing/lampstamp"
+)
+
+// TestVersionedStore runs the conformance tests every VersionedStore has to
+// pass. newStore is called for each test and must return an empty store.
+func TestVersionedStore(t *testing.T, newStore func(t *testing.T) lampstamp.VersionedStore) {
+	t.Run("LoadMissing", func(t *testing.T) {
+		s := newStore(t)
+		_, _, err := s.Load(context.Background(), "missing")
+		if !errors.Is(err, lampstamp.ErrNotFound) {
+			t.Fatalf("Load of a missing key: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("StoreAndLoad", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+
+		mustStore(t, s, "msg-id-1", "foo", 1)
+		mustLoad(t, s, "msg-id-1", "foo", 1)
+
+		mustStore(t, s, "msg-id-1", "bar", 3)
+		mustLoad(t, s, "msg-id-1", "bar", 3)
+
+		mustStore(t, s, "msg-id-2", "", 1)
+		mustLoad(t, s, "msg-id-2", "", 1)
+
+		if _, _, err := s.Load(ctx, "msg-id-3"); !errors.Is(err, lampstamp.ErrNotFound) {
+			t.Fatalf("Load of a missing key: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("RejectsNonIncreasingVersions", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+
+		mustStore(t, s, "msg-id-1", "bar", 2)
+		for _, version := range []int64{2, 1, 0, -1} {
+			err := s.CompareAndStore(ctx, "msg-id-1", []byte("foo"), version)
+			var conflict *lampstamp.VersionConflictError
+			if !errors.As(err, &conflict) {
+				t.Fatalf("CompareAndStore at version %d: expected *VersionConflictError, got %v", version, err)
+			}
+			if !errors.Is(err, lampstamp.ErrVersionConflict) {
+				t.Fatalf("CompareAndStore at version %d: %v does not match ErrVersionConflict", version, err)
+			}
+			if conflict.Key != "msg-id-1" || conflict.Version != version || conflict.Stored != 2 {
+				t.Fatalf("CompareAndStore at version %d: unexpected %+v", version, conflict)
+			}
+		}
+		mustLoad(t, s, "msg-id-1", "bar", 2)
+	})
+
+	t.Run("CopiesValues", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+
+		value := []byte("foo")
+		if err := s.CompareAndStore(ctx, "msg-id-1", value, 1); err != nil {
+			t.Fatalf("CompareAndStore: %v", err)
+		}
+		value[0] = 'x'
+		loaded, _, err := s.Load(ctx, "msg-id-1")
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		loaded[1] = 'x'
+		mustLoad(t, s, "msg-id-1", "foo", 1)
+	})
+
+	t.Run("ConcurrentWritesOfOneVersion", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+
+		const writers = 16
+		var wg sync.WaitGroup
+		var l sync.Mutex
+		var won []string
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				value := strconv.Itoa(i)
+				err := s.CompareAndStore(ctx, "msg-id-1", []byte(value), 1)
+				if err == nil {
+					l.Lock()
+					won = append(won, value)
+					l.Unlock()
+				} else if !errors.Is(err, lampstamp.ErrVersionConflict) {
+					t.Errorf("CompareAndStore: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if len(won) != 1 {
+			t.Fatalf("expected exactly one write to win, got %v", won)
+		}
+		mustLoad(t, s, "msg-id-1", won[0], 1)
+	})
+
+	t.Run("ConcurrentIncreasingVersions", func(t *testing.T) {
+		s := newStore(t)
+		ctx := context.Background()
+
+		var wg sync.WaitGroup
+		for i := 1; i <= 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := s.CompareAndStore(ctx, "msg-id-1", []byte(strconv.Itoa(i)), int64(i))
+				if err != nil && !errors.Is(err, lampstamp.ErrVersionConflict) {
+					t.Errorf("CompareAndStore: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		mustLoad(t, s, "msg-id-1", "50", 50)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		s := newStore(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := s.CompareAndStore(ctx, "msg-id-1", []byte("foo"), 1); err == nil {
+			t.Fatalf("CompareAndStore with a canceled context: expected an error")
+		}
+		if _, _, err := s.Load(context.Background(), "msg-id-1"); !errors.Is(err, lampstamp.ErrNotFound) {
+			t.Fatalf("CompareAndStore with a canceled context stored a value: %v", err)
+		}
+	})
+}
+
+func mustStore(t *testing.T, s lampstamp.VersionedStore, key, value string, version int64) {
+	t.Helper()
+	if err := s.CompareAndStore(context.Background(), key, []byte(value), version); err != nil {
+		t.Fatalf("CompareAndStore(%s, %s, %d): %v", key, value, version, err)
+	}
+}
+
+func mustLoad(t *testing.T, s lampstamp.VersionedStore, key, value string, version int64) {
+	t.Helper()
+	v, ver, err := s.Load(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Load(%s): %v", key, err)
+	}
+	if string(v) != value || ver != version {
+		t.Fatalf("Load(%s): expected %q at version %d, got %q at version %d", key, value, version, v, ver)
+	}
+}
@@ -0,0 +1,261 @@
+package lampstamp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Leaser is a central clock handing out ranges of counters. It is
+// implemented by the Lampstamp variants, by Client for lampstampd and by
+// RedisClock.
+type Leaser interface {
+	GetCtx(ctx context.Context, key string) (int64, error)
+	// LeaseCtx raises key to max(counter, min) + n and returns the new
+	// counter. The n counters up to it are reserved for the caller, as the
+	// central clock never issues them again.
+	LeaseCtx(ctx context.Context, key string, min, n int64) (int64, error)
+}
+
+type TieredOptions struct {
+	// LeaseSize is the number of counters leased per key at a time, 100
+	// by default. Counters left in a lease when it is replaced are
+	// skipped, so larger leases save round trips at the cost of gaps.
+	LeaseSize int64
+	// RefreshBelow is the number of counters left in a lease below which
+	// the next lease is requested in the background, LeaseSize/4 by
+	// default. Negative disables background refresh.
+	RefreshBelow int64
+	// RefreshTimeout bounds background lease requests, 5s by default.
+	RefreshTimeout time.Duration
+	// Leases is the number of keys holding a lease, 65536 by default.
+	// Keys whose lease is evicted lease again on their next tick.
+	Leases int
+}
+
+const (
+	defaultLeaseSize      = 100
+	defaultRefreshTimeout = 5 * time.Second
+	defaultLeases         = 1 << 16
+)
+
+// TieredClock serves ticks from a local Lampstamp in front of a central
+// Leaser. Every key leases a range of counters from the central clock and
+// ticks within that range locally; a tick past the range, or of a key
+// without a lease, leases a new range first. Ranges of different servers
+// never overlap and each starts above everything the central clock has
+// handed out, so every timestamp is issued once across all servers.
+//
+// ValidateAndTickCtx validates a request within the lease of its key
+// against the local clock, without a round trip. A request above the lease
+// is validated against the central clock by leasing above it first: it is
+// stale if another server has leased past it, whether or not that server
+// has issued the counters of its lease yet. Ticks of other servers are not
+// seen before the next lease.
+type TieredClock struct {
+	local   *Lampstamp
+	backend Leaser
+	opts    TieredOptions
+
+	mu     sync.Mutex
+	leases map[string]*tieredLease
+	e      Evictor
+	flight flightGroup[string]
+}
+
+// tieredLease is the range (lo, hi] a key issues counters from, and the
+// range leased in the background to follow it, if any.
+type tieredLease struct {
+	lo, hi         int64
+	nextLo, nextHi int64
+	refreshing     bool
+}
+
+var _ Clock = (*TieredClock)(nil)
+
+func NewTieredClock(backend Leaser, to TieredOptions, opts ...Option) *TieredClock {
+	if to.LeaseSize <= 0 {
+		to.LeaseSize = defaultLeaseSize
+	}
+	if to.RefreshBelow == 0 {
+		to.RefreshBelow = to.LeaseSize / 4
+	}
+	if to.RefreshTimeout <= 0 {
+		to.RefreshTimeout = defaultRefreshTimeout
+	}
+	if to.Leases <= 0 {
+		to.Leases = defaultLeases
+	}
+
+	return &TieredClock{
+		local:   NewLampstamp(opts...),
+		backend: backend,
+		opts:    to,
+		leases:  make(map[string]*tieredLease),
+		e:       NewLRUEvictor(to.Leases),
+	}
+}
+
+// GetCtx returns the local counter of a key holding a lease, and asks the
+// central clock otherwise.
+func (t *TieredClock) GetCtx(ctx context.Context, key string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+
+	t.mu.Lock()
+	_, ok := t.leases[key]
+	t.mu.Unlock()
+	if ok {
+		return t.local.GetCtx(ctx, key)
+	}
+	return t.backend.GetCtx(ctx, key)
+}
+
+func (t *TieredClock) IncCtx(ctx context.Context, key string) (int64, error) {
+	inc := func() (int64, error) {
+		return t.local.Inc(key), nil
+	}
+	return t.tick(ctx, key, inc, inc)
+}
+
+func (t *TieredClock) TickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	tick := func() (int64, error) {
+		return t.local.Tick(key, requestTimestamp), nil
+	}
+	return t.tick(ctx, key, tick, tick)
+}
+
+func (t *TieredClock) ValidateAndTickCtx(ctx context.Context, key string, requestTimestamp int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+
+	t.mu.Lock()
+	l := t.leases[key]
+	leased := l != nil && requestTimestamp < max(l.hi, l.nextHi)
+	t.mu.Unlock()
+	if !leased {
+		// the lease starts at the central counter, which the request is
+		// then validated against
+		_, err := t.flight.do(ctx, key, func() (int64, error) {
+			return defaultTimestamp, t.lease(ctx, key, requestTimestamp)
+		})
+		if err != nil {
+			return defaultTimestamp, err
+		}
+	}
+
+	return t.tick(ctx, key, func() (int64, error) {
+		return t.local.ValidateAndTick(key, requestTimestamp)
+	}, func() (int64, error) {
+		// the request has been validated, a retry only has to move the
+		// counter into a lease
+		return t.local.Tick(key, requestTimestamp), nil
+	})
+}
+
+// tick runs op on the local clock and returns its counter once it lies in
+// the lease of key. Otherwise a lease above the counter is taken, and if
+// the counter is not in it either, it is skipped and retry runs until it
+// yields a leased counter.
+func (t *TieredClock) tick(ctx context.Context, key string, op, retry func() (int64, error)) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return defaultTimestamp, err
+	}
+
+	var (
+		val    int64
+		leased bool
+	)
+	for {
+		t.mu.Lock()
+		if !leased {
+			var err error
+			if val, err = op(); err != nil {
+				t.mu.Unlock()
+				return val, err
+			}
+			op = retry
+		}
+		leased = false
+
+		l := t.leases[key]
+		if l != nil && val > l.hi && l.nextHi > 0 {
+			l.lo, l.hi = l.nextLo, l.nextHi
+			l.nextLo, l.nextHi = 0, 0
+		}
+
+		switch {
+		case l != nil && val > l.lo && val <= l.hi:
+			t.e.Touch(key)
+			if l.hi-val < t.opts.RefreshBelow && l.nextHi == 0 && !l.refreshing {
+				l.refreshing = true
+				go t.refresh(key, l, l.hi)
+			}
+			t.mu.Unlock()
+			return val, nil
+		case l != nil && val <= l.lo:
+			// the local clock lost the key, or has yet to catch up with
+			// a new lease
+			t.local.advance(key, l.lo)
+			t.mu.Unlock()
+			continue
+		}
+		t.mu.Unlock()
+
+		_, err := t.flight.do(ctx, key, func() (int64, error) {
+			return defaultTimestamp, t.lease(ctx, key, val-1)
+		})
+		if err != nil {
+			return defaultTimestamp, err
+		}
+		leased = true
+	}
+}
+
+// lease takes a lease above min from the central clock and makes it the
+// current lease of key.
+func (t *TieredClock) lease(ctx context.Context, key string, min int64) error {
+	hi, err := t.backend.LeaseCtx(ctx, key, min, t.opts.LeaseSize)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, ok := t.leases[key]
+	if !ok {
+		l = &tieredLease{}
+		t.leases[key] = l
+		for _, evicted := range t.e.Add(key) {
+			delete(t.leases, evicted)
+		}
+	}
+	if hi > l.hi {
+		l.lo, l.hi = hi-t.opts.LeaseSize, hi
+		if l.nextHi <= hi {
+			l.nextLo, l.nextHi = 0, 0
+		}
+	}
+	t.local.advance(key, l.lo)
+	return nil
+}
+
+// refresh leases the range to follow l in the background.
+func (t *TieredClock) refresh(key string, l *tieredLease, min int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.opts.RefreshTimeout)
+	defer cancel()
+
+	hi, err := t.backend.LeaseCtx(ctx, key, min, t.opts.LeaseSize)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l.refreshing = false
+	// a failed refresh is retried by the next tick or the next miss
+	if err == nil && t.leases[key] == l && hi > l.hi {
+		l.nextLo, l.nextHi = hi-t.opts.LeaseSize, hi
+	}
+}
@@ -0,0 +1,268 @@
+package lampstamp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingLeaser counts the leases taken from a Leaser and can fail them.
+type countingLeaser struct {
+	Leaser
+
+	mu     sync.Mutex
+	leases int
+	err    error
+}
+
+func (c *countingLeaser) LeaseCtx(ctx context.Context, key string, min, n int64) (int64, error) {
+	c.mu.Lock()
+	c.leases++
+	err := c.err
+	c.mu.Unlock()
+
+	if err != nil {
+		return defaultTimestamp, err
+	}
+	return c.Leaser.LeaseCtx(ctx, key, min, n)
+}
+
+func (c *countingLeaser) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.leases
+}
+
+func (c *countingLeaser) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+}
+
+func TestTieredClock(t *testing.T) {
+	central := NewLampstamp()
+	backend := &countingLeaser{Leaser: central}
+	tc := NewTieredClock(backend, TieredOptions{LeaseSize: 10, RefreshBelow: -1})
+	ctx := context.Background()
+
+	for i := int64(1); i <= 3; i++ {
+		ts, err := tc.IncCtx(ctx, "msg-id-1")
+		require.NoError(t, err)
+		assert.Equal(t, i, ts)
+	}
+	assert.Equal(t, 1, backend.count())
+	assert.EqualValues(t, 10, central.Get("msg-id-1"))
+
+	// a tick past the lease leases above it
+	ts, err := tc.TickCtx(ctx, "msg-id-1", 50)
+	require.NoError(t, err)
+	assert.EqualValues(t, 51, ts)
+	assert.Equal(t, 2, backend.count())
+	assert.EqualValues(t, 60, central.Get("msg-id-1"))
+
+	ts, err = tc.ValidateAndTickCtx(ctx, "msg-id-1", 40)
+	assert.ErrorIs(t, err, ErrStale)
+	assert.EqualValues(t, 51, ts)
+	ts, err = tc.ValidateAndTickCtx(ctx, "msg-id-1", 55)
+	require.NoError(t, err)
+	assert.EqualValues(t, 56, ts)
+
+	// a validated request past the lease is not rejected by the new one
+	ts, err = tc.ValidateAndTickCtx(ctx, "msg-id-1", 70)
+	require.NoError(t, err)
+	assert.EqualValues(t, 71, ts)
+	assert.Equal(t, 3, backend.count())
+
+	// leased keys are read locally, others from the central clock
+	ts, err = tc.GetCtx(ctx, "msg-id-1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 71, ts)
+	central.Tick("msg-id-2", 5)
+	ts, err = tc.GetCtx(ctx, "msg-id-2")
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, ts)
+}
+
+func TestTieredClockRefresh(t *testing.T) {
+	backend := &countingLeaser{Leaser: NewLampstamp()}
+	tc := NewTieredClock(backend, TieredOptions{LeaseSize: 10, RefreshBelow: 5})
+	ctx := context.Background()
+
+	for i := 0; i < 6; i++ {
+		_, err := tc.IncCtx(ctx, "msg-id-1")
+		require.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool { return backend.count() == 2 }, time.Second, time.Millisecond)
+
+	// the lease taken in the background follows the current one
+	for i := int64(7); i <= 16; i++ {
+		ts, err := tc.IncCtx(ctx, "msg-id-1")
+		require.NoError(t, err)
+		assert.Equal(t, i, ts)
+	}
+	assert.Eventually(t, func() bool { return backend.count() == 3 }, time.Second, time.Millisecond)
+}
+
+func TestTieredClockBackendError(t *testing.T) {
+	errDown := errors.New("central clock is down")
+	backend := &countingLeaser{Leaser: NewLampstamp()}
+	tc := NewTieredClock(backend, TieredOptions{LeaseSize: 10, RefreshBelow: -1})
+	ctx := context.Background()
+
+	_, err := tc.IncCtx(ctx, "msg-id-1")
+	require.NoError(t, err)
+
+	// ticks within the lease go on without the central clock
+	backend.fail(errDown)
+	ts, err := tc.IncCtx(ctx, "msg-id-1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, ts)
+
+	_, err = tc.TickCtx(ctx, "msg-id-1", 10)
+	assert.ErrorIs(t, err, errDown)
+	_, err = tc.IncCtx(ctx, "msg-id-2")
+	assert.ErrorIs(t, err, errDown)
+
+	// the counter of the failed tick is skipped
+	backend.fail(nil)
+	ts, err = tc.TickCtx(ctx, "msg-id-1", 10)
+	require.NoError(t, err)
+	assert.EqualValues(t, 12, ts)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = tc.IncCtx(cctx, "msg-id-1")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTieredClockEviction(t *testing.T) {
+	backend := &countingLeaser{Leaser: NewLampstamp()}
+	tc := NewTieredClock(backend, TieredOptions{LeaseSize: 10, RefreshBelow: -1, Leases: 1},
+		WithEvictor(NewLRUEvictor(1)))
+	ctx := context.Background()
+
+	last := map[string]int64{}
+	for i := 0; i < 20; i++ {
+		for _, key := range []string{"msg-id-1", "msg-id-2"} {
+			ts, err := tc.IncCtx(ctx, key)
+			require.NoError(t, err)
+			assert.Greater(t, ts, last[key])
+			last[key] = ts
+		}
+	}
+	// every tick had to lease again
+	assert.Equal(t, 40, backend.count())
+}
+
+func TestTieredClockShared(t *testing.T) {
+	central := NewLampstamp()
+	addr := startTestServer(t, central)
+	ctx := context.Background()
+
+	var clocks []*TieredClock
+	for i := 0; i < 3; i++ {
+		c, err := Dial(ctx, addr)
+		require.NoError(t, err)
+		defer c.Close()
+		clocks = append(clocks, NewTieredClock(c, TieredOptions{LeaseSize: 16}))
+	}
+
+	var (
+		mu   sync.Mutex
+		seen = map[int64]bool{}
+		wg   sync.WaitGroup
+	)
+	for _, tc := range clocks {
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(tc *TieredClock) {
+				defer wg.Done()
+
+				var last int64
+				for i := 0; i < 200; i++ {
+					ts, err := tc.IncCtx(ctx, "msg-id-1")
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Greater(t, ts, last)
+					last = ts
+
+					mu.Lock()
+					assert.False(t, seen[ts], "%d issued twice", ts)
+					seen[ts] = true
+					mu.Unlock()
+				}
+			}(tc)
+		}
+	}
+	wg.Wait()
+	assert.Len(t, seen, 2400)
+
+	// a timestamp issued by one server is causally followed on another
+	ts, err := clocks[0].IncCtx(ctx, "msg-id-2")
+	require.NoError(t, err)
+	next, err := clocks[1].TickCtx(ctx, "msg-id-2", ts)
+	require.NoError(t, err)
+	assert.Greater(t, next, ts)
+
+	for key := range seen {
+		assert.LessOrEqual(t, key, central.Get("msg-id-1"))
+	}
+}
+
+func TestTieredClockValidateAcrossServers(t *testing.T) {
+	central := NewLampstamp()
+	backend := &countingLeaser{Leaser: central}
+	a := NewTieredClock(backend, TieredOptions{LeaseSize: 100, RefreshBelow: -1})
+	b := NewTieredClock(central, TieredOptions{LeaseSize: 100, RefreshBelow: -1})
+	ctx := context.Background()
+
+	ts, err := a.IncCtx(ctx, "k")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, ts)
+	ts, err = b.IncCtx(ctx, "k")
+	require.NoError(t, err)
+	assert.EqualValues(t, 101, ts)
+
+	// requests within the lease are validated locally
+	ts, err = a.ValidateAndTickCtx(ctx, "k", 1)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, ts)
+	_, err = a.ValidateAndTickCtx(ctx, "k", 1)
+	assert.ErrorIs(t, err, ErrStale)
+	assert.Equal(t, 1, backend.count())
+
+	// others against the central clock, which b has leased past
+	ts, err = a.ValidateAndTickCtx(ctx, "k", 150)
+	var stale *StaleError
+	require.ErrorAs(t, err, &stale)
+	assert.EqualValues(t, 200, stale.Current)
+	assert.EqualValues(t, 200, ts)
+	assert.Equal(t, 2, backend.count())
+
+	// a itself now holds the latest lease
+	ts, err = a.ValidateAndTickCtx(ctx, "k", 200)
+	require.NoError(t, err)
+	assert.EqualValues(t, 201, ts)
+	ts, err = b.ValidateAndTickCtx(ctx, "k", 250)
+	assert.ErrorIs(t, err, ErrStale)
+	assert.EqualValues(t, 300, ts)
+	assert.Equal(t, 2, backend.count())
+}
+
+func BenchmarkTieredClockTick(b *testing.B) {
+	tc := NewTieredClock(NewLampstamp(), TieredOptions{LeaseSize: 1000})
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tc.TickCtx(ctx, "msg-id-1", int64(i))
+	}
+}
@@ -0,0 +1,110 @@
+package lampstamp
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Transport is an http.RoundTripper doing what the example Client.send
+// does: it increments the clock for the key of a request, sends the new
+// timestamp along, and ticks the clock with the timestamp of a successful
+// response. Non-2xx responses do not tick the clock, and 409 Conflict is
+// turned into a *StaleError carrying the current timestamp of the server,
+// so that callers can tick to it and retry.
+type Transport struct {
+	Base  http.RoundTripper
+	Clock Clock
+
+	// KeyHeader and TimestampHeader default to DefaultKeyHeader and
+	// DefaultTimestampHeader.
+	KeyHeader       string
+	TimestampHeader string
+
+	// Key, if set, derives the key from the request instead of KeyHeader.
+	Key func(r *http.Request) string
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := t.key(req)
+	if key == "" {
+		return t.base().RoundTrip(req)
+	}
+
+	ts, err := t.Clock.IncCtx(req.Context(), key)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	// a RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	req.Header.Set(t.keyHeader(), key)
+	req.Header.Set(t.timestampHeader(), strconv.FormatInt(ts, 10))
+
+	resp, err := t.base().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusConflict {
+		current, _ := strconv.ParseInt(resp.Header.Get(t.timestampHeader()), 10, 64)
+		drainBody(resp)
+		return nil, &StaleError{Key: key, Request: ts, Current: current}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, nil
+	}
+
+	if h := resp.Header.Get(t.timestampHeader()); h != "" {
+		responseTimestamp, err := strconv.ParseInt(h, 10, 64)
+		if err != nil {
+			drainBody(resp)
+			return nil, err
+		}
+		if _, err := t.Clock.TickCtx(req.Context(), key, responseTimestamp); err != nil {
+			drainBody(resp)
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func (t *Transport) key(r *http.Request) string {
+	if t.Key != nil {
+		return t.Key(r)
+	}
+	return r.Header.Get(t.keyHeader())
+}
+
+func (t *Transport) keyHeader() string {
+	if t.KeyHeader != "" {
+		return t.KeyHeader
+	}
+	return DefaultKeyHeader
+}
+
+func (t *Transport) timestampHeader() string {
+	if t.TimestampHeader != "" {
+		return t.TimestampHeader
+	}
+	return DefaultTimestampHeader
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+func drainBody(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+}
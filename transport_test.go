@@ -0,0 +1,106 @@
+package lampstamp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, server Clock) *httptest.Server {
+	m := &Middleware{Clock: server}
+	s := httptest.NewServer(m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newKeyedRequest(t *testing.T, url, key string) *http.Request {
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader("foo"))
+	require.NoError(t, err)
+	req.Header.Set(DefaultKeyHeader, key)
+	return req
+}
+
+func TestTransport(t *testing.T) {
+	server := NewLampstamp()
+	s := newTestServer(t, server)
+
+	client := NewLampstamp()
+	c := &http.Client{Transport: &Transport{Clock: client}}
+
+	req := newKeyedRequest(t, s.URL, "msg-id-1")
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "2", resp.Header.Get(DefaultTimestampHeader))
+	assert.EqualValues(t, 3, client.Get("msg-id-1"))
+	assert.Empty(t, req.Header.Get(DefaultTimestampHeader))
+
+	// a second client writes in between
+	other := &http.Client{Transport: &Transport{Clock: NewLampstamp()}}
+	server.Tick("msg-id-1", 10)
+	resp, err = other.Do(newKeyedRequest(t, s.URL, "msg-id-1"))
+	assert.Nil(t, resp)
+
+	var stale *StaleError
+	require.True(t, errors.As(err, &stale))
+	assert.Equal(t, "msg-id-1", stale.Key)
+	assert.EqualValues(t, 1, stale.Request)
+	assert.EqualValues(t, 11, stale.Current)
+
+	// the first client has not seen it either
+	_, err = c.Do(newKeyedRequest(t, s.URL, "msg-id-1"))
+	assert.ErrorIs(t, err, ErrStale)
+	assert.EqualValues(t, 4, client.Get("msg-id-1"))
+
+	// after catching up the retry goes through
+	client.Tick("msg-id-1", stale.Current)
+	resp, err = c.Do(newKeyedRequest(t, s.URL, "msg-id-1"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.EqualValues(t, 15, client.Get("msg-id-1"))
+}
+
+func TestTransportSkipsTickOnError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(DefaultTimestampHeader, "100")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer s.Close()
+
+	client := NewLampstamp()
+	c := &http.Client{Transport: &Transport{Clock: client}}
+
+	resp, err := c.Do(newKeyedRequest(t, s.URL, "msg-id-1"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.EqualValues(t, 1, client.Get("msg-id-1"))
+}
+
+func TestTransportWithoutKey(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(DefaultTimestampHeader))
+	}))
+	defer s.Close()
+
+	c := &http.Client{Transport: &Transport{Clock: NewLampstamp()}}
+	resp, err := c.Get(s.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestTransportClockError(t *testing.T) {
+	s := newTestServer(t, NewLampstamp())
+	c := &http.Client{Transport: &Transport{Clock: NewLampstamp()}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Do(newKeyedRequest(t, s.URL, "msg-id-1").WithContext(ctx))
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,181 @@
+package lampstamp
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Vector maps node IDs to their counters. Missing nodes count as zero.
+type Vector map[string]int64
+
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	case Concurrent:
+		return "concurrent"
+	}
+	return "Ordering(" + strconv.Itoa(int(o)) + ")"
+}
+
+// Compare tells whether v happened before, after or concurrently with
+// other.
+func (v Vector) Compare(other Vector) Ordering {
+	less, greater := false, false
+	for node, val := range v {
+		if val < other[node] {
+			less = true
+		} else if val > other[node] {
+			greater = true
+		}
+	}
+	for node, val := range other {
+		if _, ok := v[node]; !ok && val > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+func (v Vector) Clone() Vector {
+	c := make(Vector, len(v))
+	for node, val := range v {
+		c[node] = val
+	}
+	return c
+}
+
+// merge raises every counter of v to the one in other.
+func (v Vector) merge(other Vector) {
+	for node, val := range other {
+		v[node] = max(v[node], val)
+	}
+}
+
+func (v Vector) String() string {
+	nodes := make([]string, 0, len(v))
+	for node := range v {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, node := range nodes {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(node)
+		sb.WriteByte(':')
+		sb.WriteString(strconv.FormatInt(v[node], 10))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// VectorClock keeps a vector per key for the node it runs on. Like
+// Lampstamp it holds a bounded number of keys chosen by an Evictor, and
+// keys it does not hold start from the merge of every evicted vector so
+// that no key goes backwards.
+type VectorClock struct {
+	node string
+	m    map[string]Vector
+	l    sync.RWMutex
+	e    Evictor
+
+	floor Vector
+}
+
+func NewVectorClock(node string, opts ...Option) *VectorClock {
+	o := newOptions(opts)
+
+	return &VectorClock{
+		node:  node,
+		m:     make(map[string]Vector),
+		e:     o.evictor,
+		floor: make(Vector),
+	}
+}
+
+func (vc *VectorClock) Node() string {
+	return vc.node
+}
+
+// Get returns a copy of the vector of key.
+func (vc *VectorClock) Get(key string) Vector {
+	vc.l.RLock()
+	defer vc.l.RUnlock()
+
+	if v, ok := vc.m[key]; ok {
+		return v.Clone()
+	}
+	return vc.floor.Clone()
+}
+
+// Inc counts a local event on key.
+func (vc *VectorClock) Inc(key string) Vector {
+	vc.l.Lock()
+	defer vc.l.Unlock()
+
+	v := vc.vector(key)
+	v[vc.node]++
+	return v.Clone()
+}
+
+// Merge counts the receipt of remote on key, taking the maximum of every
+// counter before counting the event.
+func (vc *VectorClock) Merge(key string, remote Vector) Vector {
+	vc.l.Lock()
+	defer vc.l.Unlock()
+
+	v := vc.vector(key)
+	v.merge(remote)
+	v[vc.node]++
+	return v.Clone()
+}
+
+// Compare orders remote relative to the vector of key. Concurrent means
+// remote was written without seeing the local state, and vice versa.
+func (vc *VectorClock) Compare(key string, remote Vector) Ordering {
+	return remote.Compare(vc.Get(key))
+}
+
+// vector returns the stored vector of key, admitting the key if needed.
+func (vc *VectorClock) vector(key string) Vector {
+	if v, ok := vc.m[key]; ok {
+		vc.e.Touch(key)
+		return v
+	}
+
+	v := vc.floor.Clone()
+	vc.m[key] = v
+	for _, evicted := range vc.e.Add(key) {
+		vc.floor.merge(vc.m[evicted])
+		delete(vc.m, evicted)
+	}
+	return v
+}
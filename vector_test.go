@@ -0,0 +1,68 @@
+package lampstamp
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVectorCompare(t *testing.T) {
+	tests := []struct {
+		a, b     Vector
+		expected Ordering
+	}{
+		{Vector{}, Vector{}, Equal},
+		{Vector{"a": 1}, Vector{"a": 1, "b": 0}, Equal},
+		{Vector{"a": 1}, Vector{"a": 2}, Before},
+		{Vector{"a": 1}, Vector{"a": 1, "b": 1}, Before},
+		{Vector{"a": 2, "b": 1}, Vector{"a": 1}, After},
+		{Vector{"a": 2}, Vector{"b": 1}, Concurrent},
+		{Vector{"a": 2, "b": 1}, Vector{"a": 1, "b": 2}, Concurrent},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, tt.a.Compare(tt.b), "%s vs %s", tt.a, tt.b)
+	}
+}
+
+func TestVectorClock(t *testing.T) {
+	svr1 := NewVectorClock("svr-1")
+	svr2 := NewVectorClock("svr-2")
+
+	v1 := svr1.Inc("msg")
+	assert.Equal(t, Vector{"svr-1": 1}, v1)
+
+	// svr-2 has seen v1, its write comes after it
+	v2 := svr2.Merge("msg", v1)
+	assert.Equal(t, Vector{"svr-1": 1, "svr-2": 1}, v2)
+	assert.Equal(t, Before, v1.Compare(v2))
+
+	// both write without seeing each other
+	v3 := svr1.Inc("msg")
+	v4 := svr2.Inc("msg")
+	assert.Equal(t, Concurrent, v3.Compare(v4))
+	assert.Equal(t, Concurrent, svr1.Compare("msg", v4))
+
+	v5 := svr1.Merge("msg", v4)
+	assert.Equal(t, Vector{"svr-1": 3, "svr-2": 2}, v5)
+	assert.Equal(t, After, v5.Compare(v4))
+	assert.Equal(t, Equal, svr1.Compare("msg", v5))
+
+	// returned vectors are copies
+	v5["svr-1"] = 100
+	assert.EqualValues(t, 3, svr1.Get("msg")["svr-1"])
+}
+
+func TestVectorClockEviction(t *testing.T) {
+	vc := NewVectorClock("n", WithEvictor(NewLRUEvictor(2)))
+	last := make(map[string]Vector)
+	for i := 0; i < 30; i++ {
+		key := strconv.Itoa(i % 5)
+		v := vc.Merge(key, Vector{"remote": int64(i)})
+		if prev, ok := last[key]; ok {
+			assert.Equal(t, After, v.Compare(prev))
+		}
+		last[key] = v
+	}
+	assert.LessOrEqual(t, len(vc.m), 2)
+}